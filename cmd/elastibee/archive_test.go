@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/auth"
+	"github.com/pzl/elastibee/pkg/eco"
+	"github.com/pzl/elastibee/pkg/eco/ecotest"
+	"github.com/pzl/elastibee/pkg/elastic"
+	"github.com/pzl/elastibee/pkg/elastic/elastictest"
+)
+
+// one day of 5 minute intervals, for the fake's thermostat and its two
+// sensors
+const docsPerDay = 288 * 3
+
+// runs the test from an empty directory, where archive/ is written
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) }) // nolint
+	return dir
+}
+
+// fakes for both ends of an archive run, and an app authorized with the
+// ecobee one
+func archiveFakes(t *testing.T) (*ecotest.Server, *elastictest.Server, *eco.App) {
+	t.Helper()
+	eco.SetRateLimit(0, 1)
+	pause := windowPause
+	windowPause = 0
+	t.Cleanup(func() { windowPause = pause })
+
+	dir := inTempDir(t)
+	ecoSrv := ecotest.NewServer()
+	t.Cleanup(ecoSrv.Close)
+	esSrv := elastictest.NewServer()
+	t.Cleanup(esSrv.Close)
+
+	a := &eco.App{AppKey: ecotest.AppKey}
+	a.SetAPI(ecoSrv.API())
+	a.SetStore(eco.FileStore{Path: filepath.Join(dir, "app.json")})
+	access, refresh := ecoSrv.Tokens()
+	if err := a.SetTokens(auth.TokenResponse{AccessToken: access, Refresh: refresh, Expires: 3600, Scope: auth.ScopeWrite}); err != nil {
+		t.Fatal(err)
+	}
+	return ecoSrv, esSrv, a
+}
+
+func countLines(t *testing.T, file string) int {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestArchive(t *testing.T) {
+	ecoSrv, esSrv, a := archiveFakes(t)
+	ctx := context.Background()
+
+	// two 20 day windows bring it up to date
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -30)
+	err := archive(ctx, ctx, profile{}, a, elastic.New(esSrv.URL), elastic.BulkIndexerOptions{FlushInterval: -1}, start)
+	if err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+
+	if n := ecoSrv.Requests("/1/runtimeReport"); n != 2 {
+		t.Errorf("%d runtime report requests, expected 2", n)
+	}
+	ix := esSrv.Index(defaultIndex)
+	if ix == nil {
+		t.Fatalf("index %s was not created", defaultIndex)
+	}
+	if len(ix.Settings) == 0 {
+		t.Errorf("index %s was not created from the built-in mapping", defaultIndex)
+	}
+	if n := len(ix.Docs); n != 2*20*docsPerDay {
+		t.Errorf("%d documents indexed, expected %d", n, 2*20*docsPerDay)
+	}
+
+	// each window is kept on disk as the bulk request lines sent for it
+	for w := 0; w < 2; w++ {
+		from := start.AddDate(0, 0, 20*w)
+		file := filepath.Join("archive", from.Format("20060102")+"-"+from.AddDate(0, 0, 19).Format("20060102")+".json")
+		if n := countLines(t, file); n != 2*20*docsPerDay {
+			t.Errorf("%s has %d lines, expected %d", file, n, 2*20*docsPerDay)
+		}
+	}
+
+	st, err := loadState("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := start.AddDate(0, 0, 40).Format("2006-01-02"); st.Next != next {
+		t.Errorf("saved progress resumes from %s, expected %s", st.Next, next)
+	}
+}
+
+func TestArchiveStopped(t *testing.T) {
+	ecoSrv, esSrv, a := archiveFakes(t)
+	stop, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -30)
+	err := archive(stop, context.Background(), profile{}, a, elastic.New(esSrv.URL), elastic.BulkIndexerOptions{FlushInterval: -1}, start)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected archive to stop with context.Canceled, got %v", err)
+	}
+	if n := ecoSrv.Requests("/1/runtimeReport"); n != 0 {
+		t.Errorf("%d runtime reports requested after stopping", n)
+	}
+	if _, err := loadState("archive"); !os.IsNotExist(err) {
+		t.Errorf("progress saved without archiving anything: %v", err)
+	}
+}
+
+func TestArchiveRerun(t *testing.T) {
+	on := true
+	for name, p := range map[string]profile{
+		"index":       {},
+		"data stream": {profileConfig: profileConfig{DataStream: &on}},
+	} {
+		p := p
+		t.Run(name, func(t *testing.T) {
+			_, esSrv, a := archiveFakes(t)
+			ctx := context.Background()
+			client := elastic.New(esSrv.URL)
+
+			// a window archived again, as after a crash before saving progress
+			start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -20)
+			for run := 1; run <= 2; run++ {
+				if err := archive(ctx, ctx, p, a, client, elastic.BulkIndexerOptions{FlushInterval: -1}, start); err != nil {
+					t.Fatalf("archive run %d: %v", run, err)
+				}
+			}
+			if n := len(esSrv.Docs(p.index())); n != 20*docsPerDay {
+				t.Errorf("%d documents stored after archiving twice, expected %d", n, 20*docsPerDay)
+			}
+		})
+	}
+}
+
+func TestArchivePeriod(t *testing.T) {
+	_, esSrv, a := archiveFakes(t)
+	ctx := context.Background()
+	p := profile{profileConfig: profileConfig{Period: elastic.Monthly}}
+
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -20)
+	if err := archive(ctx, ctx, p, a, elastic.New(esSrv.URL), elastic.BulkIndexerOptions{FlushInterval: -1}, start); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+
+	tmpl := esSrv.Template(defaultIndex)
+	if tmpl == nil {
+		t.Fatalf("no index template %s installed", defaultIndex)
+	}
+	if want := []string{"eco-thermostat-*", "eco-sensor-*"}; fmt.Sprint(tmpl.Patterns) != fmt.Sprint(want) {
+		t.Errorf("template matches %v, expected %v", tmpl.Patterns, want)
+	}
+
+	// every document lands in the index for its type and month, each of
+	// them read through the alias
+	total := 0
+	for _, name := range esSrv.Indices() {
+		ix := esSrv.Index(name)
+		if fmt.Sprint(ix.Aliases) != "["+defaultIndex+"]" {
+			t.Errorf("index %s has aliases %v, expected just %s", name, ix.Aliases, defaultIndex)
+		}
+		for _, d := range ix.Docs {
+			ts, err := time.Parse("2006-01-02T15:04:05", d.Source["@timestamp"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := defaultIndex + "-" + d.Source["type"].(string) + "-" + ts.Format("2006.01"); name != want {
+				t.Fatalf("document from %s of type %s stored in %s, expected %s", ts, d.Source["type"], name, want)
+			}
+		}
+		total += len(ix.Docs)
+	}
+	if total != 20*docsPerDay {
+		t.Errorf("%d documents stored, expected %d", total, 20*docsPerDay)
+	}
+	if n := len(esSrv.Docs(defaultIndex)); n != total {
+		t.Errorf("alias %s reads %d documents, expected %d", defaultIndex, n, total)
+	}
+}
+
+func TestArchivePeriodIndexExists(t *testing.T) {
+	_, esSrv, a := archiveFakes(t)
+	ctx := context.Background()
+	client := elastic.New(esSrv.URL)
+	if err := client.CreateIndexContext(ctx, defaultIndex, strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+	p := profile{profileConfig: profileConfig{Period: elastic.Monthly}}
+
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -20)
+	err := archive(ctx, ctx, p, a, client, elastic.BulkIndexerOptions{FlushInterval: -1}, start)
+	if err == nil || !strings.Contains(err.Error(), "migrate") {
+		t.Fatalf("expected archive to point at migrate for the plain index, got %v", err)
+	}
+	if esSrv.Template(defaultIndex) != nil {
+		t.Error("template installed over the plain index")
+	}
+
+	// once migrated, the name is an alias the time-based indices can join
+	if err := client.CreateIndexContext(ctx, defaultIndex+"-v1", strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+	err = client.UpdateAliasesContext(ctx,
+		elastic.AliasAction{RemoveIndex: &elastic.AliasTarget{Index: defaultIndex}},
+		elastic.AliasAction{Add: &elastic.AliasTarget{Index: defaultIndex + "-v1", Alias: defaultIndex}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive(ctx, ctx, p, a, client, elastic.BulkIndexerOptions{FlushInterval: -1}, start); err != nil {
+		t.Fatalf("archive behind an alias: %v", err)
+	}
+	if n := len(esSrv.Docs(defaultIndex)); n != 20*docsPerDay {
+		t.Errorf("alias %s reads %d documents, expected %d", defaultIndex, n, 20*docsPerDay)
+	}
+}
+
+func TestCheckAliasFreeError(t *testing.T) {
+	// no such alias, but the index can't be looked up
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_alias/") {
+			http.Error(w, `{"error":"alias [eco] missing","status":404}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	p := profile{profileConfig: profileConfig{Period: elastic.Monthly}}
+
+	err := p.checkAliasFree(context.Background(), elastic.New(srv.URL))
+	var ee *elastic.Error
+	if !errors.As(err, &ee) || ee.Status != http.StatusBadGateway {
+		t.Errorf("expected the failed lookup back, got %v", err)
+	}
+}
+
+func TestArchiveDataStream(t *testing.T) {
+	_, esSrv, a := archiveFakes(t)
+	ctx := context.Background()
+	on := true
+	p := profile{profileConfig: profileConfig{
+		DataStream: &on,
+		Lifecycle:  &lifecycleConfig{RolloverAge: "30d", DeleteAfter: "365d"},
+	}}
+
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -20)
+	if err := archive(ctx, ctx, p, a, elastic.New(esSrv.URL), elastic.BulkIndexerOptions{FlushInterval: -1}, start); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+
+	tmpl := esSrv.Template(defaultIndex)
+	if tmpl == nil || !tmpl.DataStream || fmt.Sprint(tmpl.Patterns) != "["+defaultIndex+"]" {
+		t.Fatalf("expected a data stream template matching just %s, got %+v", defaultIndex, tmpl)
+	}
+	if !strings.Contains(string(tmpl.Body), `"index.lifecycle.name":"`+defaultIndex+`"`) {
+		t.Errorf("template does not apply the lifecycle policy: %s", tmpl.Body)
+	}
+	var policy struct {
+		Policy struct {
+			Phases map[string]json.RawMessage `json:"phases"`
+		} `json:"policy"`
+	}
+	if err := json.Unmarshal(esSrv.Policy(defaultIndex), &policy); err != nil {
+		t.Fatalf("lifecycle policy %s: %v", defaultIndex, err)
+	}
+	if _, ok := policy.Policy.Phases["delete"]; !ok || len(policy.Policy.Phases) != 2 {
+		t.Errorf("expected hot and delete phases, got %v", policy.Policy.Phases)
+	}
+
+	// the stream only takes creates, so every document arriving shows they
+	// were sent that way
+	ds := esSrv.DataStream(defaultIndex)
+	if ds == nil {
+		t.Fatalf("data stream %s was not created", defaultIndex)
+	}
+	if n := len(esSrv.Docs(defaultIndex)); n != 20*docsPerDay {
+		t.Errorf("%d documents stored, expected %d", n, 20*docsPerDay)
+	}
+	file := filepath.Join("archive", start.Format("20060102")+"-"+start.AddDate(0, 0, 19).Format("20060102")+".json")
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for i := 0; sc.Scan(); i++ {
+		if i%2 == 0 && !strings.HasPrefix(sc.Text(), `{"create":{"_id":`) {
+			t.Fatalf("%s line %d is not a create: %s", file, i+1, sc.Text())
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// asks the desktop to open url in the default browser
+func openBrowser(url string) error {
+	var cmd string
+	var args []string
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = "open"
+	case "windows":
+		cmd = "rundll32"
+		args = []string{"url.dll,FileProtocolHandler"}
+	default:
+		cmd = "xdg-open"
+	}
+	return exec.Command(cmd, append(args, url)...).Start()
+}
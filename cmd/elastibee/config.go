@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/eco"
+	"github.com/pzl/elastibee/pkg/elastic"
+)
+
+// settings read from the config file. Everything is optional
+type config struct {
+	profileConfig
+	Notify  notifyConfig  `json:"notify"`
+	Elastic elasticConfig `json:"elastic"`
+
+	// named ecobee accounts, for collecting from several homes. Settings
+	// they leave out fall back to the ones above
+	Profiles map[string]profileConfig `json:"profiles"`
+}
+
+// settings for one ecobee account
+type profileConfig struct {
+	Store storeConfig `json:"store"`
+
+	// what to authorize for: smartRead (enough for archiving), smartWrite
+	// or ems. Tokens keep whatever they were issued with until the next pin
+	// or authorize
+	Scope string `json:"scope"`
+
+	Index string `json:"index"` // elasticsearch index to archive into, default eco
+	Home  string `json:"home"`  // tagged on documents, default the profile name
+
+	// file with the settings and mappings indices are created with, in
+	// place of the built-in mapping
+	Mapping string `json:"mapping"`
+
+	// monthly or yearly to split documents into an index per type and
+	// period, <index>-<type>-<period>, read through an alias named index
+	Period string `json:"period"`
+
+	// archive into a data stream named index, created from an index
+	// template, optionally managed by the lifecycle policy. A pointer so a
+	// profile can turn off a data stream set at the top level
+	DataStream *bool            `json:"data_stream"`
+	Lifecycle  *lifecycleConfig `json:"lifecycle"`
+}
+
+// the ILM policy for a data stream. Sizes and ages in Elasticsearch units,
+// like 50gb or 30d; phases left empty are skipped
+type lifecycleConfig struct {
+	RolloverSize string `json:"rollover_size"` // primary shard size to roll over at
+	RolloverAge  string `json:"rollover_age"`
+	WarmAfter    string `json:"warm_after"` // ages count from rollover
+	ColdAfter    string `json:"cold_after"`
+	DeleteAfter  string `json:"delete_after"`
+}
+
+// where ecobee tokens are kept
+type storeConfig struct {
+	Type     string `json:"type"`      // file (default), encrypted, env or dir
+	Path     string `json:"path"`      // file or directory, depending on type
+	KeyFile  string `json:"key_file"`  // encrypted: file holding the passphrase, otherwise $ELASTIBEE_PASSPHRASE is used
+	Prefix   string `json:"prefix"`    // env: variable name prefix, default ECOBEE_
+	ReadOnly bool   `json:"read_only"` // dir: don't write refreshed tokens back
+}
+
+// the cluster to archive into. The nodes and credentials can also come
+// from $ELASTIC_URL (comma-separated), $ELASTIC_USERNAME, $ELASTIC_PASSWORD,
+// $ELASTIC_API_KEY and $ELASTIC_BEARER_TOKEN, which take precedence
+type elasticConfig struct {
+	URL         string     `json:"url"`      // default http://estc:9200
+	URLs        []string   `json:"urls"`     // more nodes to spread requests over
+	Discover    bool       `json:"discover"` // find the rest of the nodes from _nodes/http
+	Username    string     `json:"username"`
+	Password    string     `json:"password"`
+	APIKey      string     `json:"api_key"` // encoded, or id:api_key
+	BearerToken string     `json:"bearer_token"`
+	CAFile      string     `json:"ca_file"`   // PEM certificates to trust
+	CertFile    string     `json:"cert_file"` // client certificate, PEM
+	KeyFile     string     `json:"key_file"`
+	Insecure    bool       `json:"insecure"`   // skip verifying the server certificate
+	Gzip        bool       `json:"gzip"`       // compress request bodies
+	GzipLevel   int        `json:"gzip_level"` // 1 (fastest) to 9 (smallest)
+	Bulk        bulkConfig `json:"bulk"`
+}
+
+// how documents are batched into bulk requests. Zero values take the
+// elastic package defaults
+type bulkConfig struct {
+	Docs     int    `json:"docs"`     // documents per request
+	Bytes    int    `json:"bytes"`    // request body size
+	Interval string `json:"interval"` // longest a document waits, like "5s"
+	Workers  int    `json:"workers"`  // requests in flight at once
+}
+
+// where to report problems needing attention, like lost authorization
+type notifyConfig struct {
+	Webhook string `json:"webhook"` // URL to POST a JSON event to
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "elastibee", "config.json")
+}
+
+// loads path, or the default config file if path is empty. Only an
+// explicitly named file is required to exist
+func loadConfig(path string) (config, error) {
+	var cfg config
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// opens the configured store. A file store without a path uses defaultPath
+func (sc storeConfig) open(defaultPath string) (eco.TokenStore, error) {
+	switch sc.Type {
+	case "", "file":
+		path := sc.Path
+		if path == "" {
+			path = defaultPath
+		}
+		return eco.FileStore{Path: path}, nil
+	case "encrypted":
+		if sc.Path == "" {
+			return nil, errors.New("encrypted token store needs a path")
+		}
+		if sc.KeyFile != "" {
+			return eco.NewKeyFileStore(sc.Path, sc.KeyFile)
+		}
+		pass := os.Getenv("ELASTIBEE_PASSPHRASE")
+		if pass == "" {
+			return nil, errors.New("encrypted token store needs key_file or $ELASTIBEE_PASSPHRASE")
+		}
+		return eco.EncryptedFileStore{Path: sc.Path, Passphrase: []byte(pass)}, nil
+	case "env":
+		return eco.EnvStore{Prefix: sc.Prefix}, nil
+	case "dir":
+		if sc.Path == "" {
+			return nil, errors.New("dir token store needs a path")
+		}
+		return eco.DirStore{Dir: sc.Path, ReadOnly: sc.ReadOnly}, nil
+	}
+	return nil, fmt.Errorf("unknown token store type %q", sc.Type)
+}
+
+func (ec elasticConfig) client() (elastic.Client, error) {
+	env := func(name string, v string) string {
+		if e := os.Getenv(name); e != "" {
+			return e
+		}
+		return v
+	}
+	hosts := ec.URLs
+	if ec.URL != "" {
+		hosts = append([]string{ec.URL}, hosts...)
+	}
+	if e := os.Getenv("ELASTIC_URL"); e != "" {
+		hosts = strings.Split(e, ",")
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"http://estc:9200"}
+	}
+	return elastic.NewWithOptions(elastic.Options{
+		Hosts:              hosts,
+		Username:           env("ELASTIC_USERNAME", ec.Username),
+		Password:           env("ELASTIC_PASSWORD", ec.Password),
+		APIKey:             env("ELASTIC_API_KEY", ec.APIKey),
+		BearerToken:        env("ELASTIC_BEARER_TOKEN", ec.BearerToken),
+		CAFile:             ec.CAFile,
+		CertFile:           ec.CertFile,
+		KeyFile:            ec.KeyFile,
+		InsecureSkipVerify: ec.Insecure,
+		Gzip:               ec.Gzip,
+		GzipLevel:          ec.GzipLevel,
+	})
+}
+
+func (bc bulkConfig) options() (elastic.BulkIndexerOptions, error) {
+	o := elastic.BulkIndexerOptions{
+		FlushDocs:  bc.Docs,
+		FlushBytes: bc.Bytes,
+		Workers:    bc.Workers,
+	}
+	if bc.Interval != "" {
+		d, err := time.ParseDuration(bc.Interval)
+		if err != nil {
+			return o, fmt.Errorf("elastic bulk interval: %w", err)
+		}
+		if d <= 0 {
+			return o, fmt.Errorf("elastic bulk interval must be positive, got %s", bc.Interval)
+		}
+		o.FlushInterval = d
+	}
+	return o, nil
+}
+
+func (lc lifecycleConfig) policy() elastic.LifecyclePolicy {
+	return elastic.LifecyclePolicy{
+		RolloverSize: lc.RolloverSize,
+		RolloverAge:  lc.RolloverAge,
+		WarmAfter:    lc.WarmAfter,
+		ColdAfter:    lc.ColdAfter,
+		DeleteAfter:  lc.DeleteAfter,
+	}
+}
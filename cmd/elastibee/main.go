@@ -3,11 +3,15 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/pzl/elastibee/pkg/auth"
@@ -18,108 +22,409 @@ import (
 	"github.com/pzl/tui/ansi"
 )
 
-const index = "eco"
-const indexFile = "etc/mapping.json"
+const defaultIndex = "eco"
+const builtinMapping = "built-in mapping"
 
-func pin(a *eco.App) error {
-	pin, err := auth.MakePin(a.AppKey)
+// how long archive rests between windows, sparing ecobee's rate limits
+var windowPause = 8 * time.Second
+
+func pin(ctx context.Context, p profile, a *eco.App) error {
+	ac := a.Auth()
+	pin, err := ac.MakePin(ctx, a.AppKey)
 	if err != nil {
 		return err
 	}
 
-	if tui.IsTTY(os.Stdout.Fd()) {
+	tty := tui.IsTTY(os.Stdout.Fd())
+	var tick func(time.Duration)
+	if tty {
 		fmt.Printf("%sPlease visit %shttps://www.ecobee.com/consumerportal/index.html#/my-apps%s and enter the Pin code: %s%s%s%s\n", ansi.Reset, ansi.Magenta, ansi.Reset, ansi.Bold, ansi.Blue, pin.Pin, ansi.Reset)
+		w := ansi.NewWriter(os.Stdout)
+		tick = func(left time.Duration) {
+			w.Column(0)
+			w.ClearLine()
+			fmt.Printf("Waiting for authorization... %s%d:%02d%s remaining", ansi.Bold, int(left.Minutes()), int(left.Seconds())%60, ansi.Reset)
+		}
 	} else {
-		fmt.Printf("Pin: %s\nCode: %s", pin.Pin, pin.Code)
-		return nil
+		fmt.Printf("Pin: %s\nCode: %s\nWaiting for authorization...\n", pin.Pin, pin.Code)
 	}
 
-	if !tui.IsTTY(os.Stdin.Fd()) {
-		fmt.Printf("When finished, run: %s token %s\n", os.Args[0], pin.Code)
-		return nil
+	tk, err := ac.PollToken(ctx, a.AppKey, pin, tick)
+	if tty {
+		fmt.Println()
+	}
+	if errors.Is(err, auth.ErrPinExpired) {
+		return fmt.Errorf("%w. Run %s for a new one", err, p.command("pin"))
 	}
-
-	fmt.Print("Press enter when finished...")
-	_, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
 	if err != nil {
 		return err
 	}
 
 	// write out refresh token
-	return getToken(a, pin.Code)
+	if err := a.SetTokens(tk); err != nil {
+		return err
+	}
+	if err := a.Save(); err != nil {
+		return err
+	}
+	fmt.Println("authorized")
+	return nil
+}
+
+// runs the authorization_code flow, listening for ecobee's redirect on addr
+func authorize(ctx context.Context, a *eco.App, addr string) error {
+	tty := tui.IsTTY(os.Stdout.Fd())
+	tk, err := a.Auth().AuthorizeCode(ctx, a.AppKey, addr, func(url string) {
+		if tty {
+			fmt.Printf("Opening %s%s%s in your browser. If it doesn't appear, visit it yourself\n", ansi.Magenta, url, ansi.Reset)
+			openBrowser(url) // nolint: the URL is printed either way
+		} else {
+			fmt.Printf("Visit: %s\n", url)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := a.SetTokens(tk); err != nil {
+		return err
+	}
+	if err := a.Save(); err != nil {
+		return err
+	}
+	fmt.Println("authorized")
+	return nil
 }
 
-func getToken(a *eco.App, code string) error {
-	tk, err := auth.MakeToken(a.AppKey, code)
+func getToken(ctx context.Context, a *eco.App, code string) error {
+	tk, err := a.Auth().MakeToken(ctx, a.AppKey, code)
 	if err != nil {
 		return err
 	}
 
-	if tk.AccessToken == "" || tk.Refresh == "" {
-		return errors.New("unable to fetch tokens from ecobee. Possibly empty response.")
+	if err := a.SetTokens(tk); err != nil {
+		return fmt.Errorf("unable to use tokens from ecobee: %w", err)
 	}
 
 	// write tokens
-	a.AccessToken = tk.AccessToken
-	a.RefreshToken = tk.Refresh
 	return a.Save()
 }
 
 func main() {
-	a, err := eco.Open()
+	configPath := flag.String("config", "", "config file (default elastibee/config.json in the user config dir)")
+	profileFlag := flag.String("profile", "", "profile to use, or \"all\" for archive and refresh")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-config file] [-profile name|all] init|pin|authorize|token|refresh|archive|reauth|mapping|migrate\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
 		panic(err)
 	}
+	profiles, err := cfg.profiles(*profileFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(profiles) > 1 && args[0] != "refresh" && args[0] != "archive" {
+		fmt.Fprintf(os.Stderr, "%s works on one profile at a time. Pick one with -profile\n", args[0])
+		os.Exit(1)
+	}
+	p := profiles[0]
 
-	switch os.Args[1] {
+	if args[0] == "init" {
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "parameter expected: ecobee application key")
+			os.Exit(1)
+		}
+		store, err := p.store()
+		if err != nil {
+			panic(err)
+		}
+		a := &eco.App{AppKey: args[1], Scope: p.Scope}
+		a.SetStore(store)
+		if err := a.Save(); err != nil {
+			panic(err)
+		}
+		fmt.Printf("saved. Next, run: %s\n", p.command("pin"))
+		return
+	}
+
+	stop, ctx := signalContexts()
+
+	// for the commands working on a single profile
+	open := func() *eco.App {
+		a, err := p.open(args[0])
+		if err != nil {
+			panic(err)
+		}
+		return a
+	}
+
+	switch args[0] {
 	case "pin":
-		if err := pin(a); err != nil {
+		if err := pin(stop, p, open()); err != nil {
+			panic(err)
+		}
+	case "authorize":
+		addr := "127.0.0.1:8910"
+		if len(args) >= 2 {
+			addr = args[1]
+		}
+		if err := authorize(stop, open(), addr); err != nil {
 			panic(err)
 		}
 	case "token":
-		if len(os.Args) < 3 {
+		if len(args) < 2 {
 			fmt.Fprintln(os.Stderr, "parameter expected: actual token text")
 			os.Exit(1)
 		}
-		if err := getToken(a, os.Args[2]); err != nil {
+		if err := getToken(stop, open(), args[1]); err != nil {
 			panic(err)
 		}
-	case "refresh":
-		if err := a.Refresh(); err != nil {
+	case "reauth":
+		if err := pin(stop, p, open()); err != nil {
 			panic(err)
 		}
-		fmt.Println("refresh successful")
+		// pick up an archive that stopped when authorization was lost
+		if st, err := loadState(p.archiveDir()); err == nil && st.Next != "" {
+			if err := runArchive(stop, ctx, cfg, []profile{p}, st.Next); err != nil {
+				fail(cfg, p, err)
+			}
+		}
+	case "refresh":
+		err := each(cfg, profiles, func(p profile) error {
+			a, err := p.open(args[0])
+			if err != nil {
+				return err
+			}
+			if err := a.RefreshContext(stop); err != nil {
+				return err
+			}
+			fmt.Printf("%srefresh successful\n", p.prefix())
+			return nil
+		})
+		if err != nil {
+			fail(cfg, p, err)
+		}
 	case "archive":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "parameter expected: start date")
-			os.Exit(1)
+		var date string
+		if len(args) >= 2 {
+			date = args[1]
+		}
+		if err := runArchive(stop, ctx, cfg, profiles, date); err != nil {
+			fail(cfg, p, err)
 		}
+	case "mapping":
+		if err := mappingCommand(ctx, cfg, p, args[1:]); err != nil {
+			fail(cfg, p, err)
+		}
+	case "migrate":
+		if err := migrateCommand(stop, cfg, p, args[1:]); err != nil {
+			fail(cfg, p, err)
+		}
+	}
+}
 
-		start, err := time.Parse("2006-01-02", os.Args[2])
+// archives each profile from date, or from where it last stopped when
+// date is empty
+func runArchive(stop context.Context, ctx context.Context, cfg config, profiles []profile, date string) error {
+	client, err := cfg.Elastic.client()
+	if err != nil {
+		return err
+	}
+	bulk, err := cfg.Elastic.Bulk.options()
+	if err != nil {
+		return err
+	}
+	if cfg.Elastic.Discover {
+		if err := client.DiscoverContext(ctx); err != nil {
+			return fmt.Errorf("discovering elasticsearch nodes: %w", err)
+		}
+	}
+	return each(cfg, profiles, func(p profile) error {
+		from := date
+		if from == "" {
+			if st, err := loadState(p.archiveDir()); err == nil {
+				from = st.Next // resume where the last run stopped
+			}
+		}
+		if from == "" {
+			return usageError("parameter expected: start date")
+		}
+		start, err := time.Parse("2006-01-02", from)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error parsing start date: %v", err)
-			os.Exit(1)
+			return usageError(fmt.Sprintf("error parsing start date: %v", err))
 		}
-		if err := archive(a, start); err != nil {
-			panic(err)
+
+		a, err := p.open("archive")
+		if err != nil {
+			return err
 		}
+		if len(profiles) > 1 {
+			fmt.Printf("profile %s\n", p.Name)
+		}
+		err = archive(stop, ctx, p, a, client, bulk, start)
+		if errors.Is(err, context.Canceled) {
+			return exitError{code: exitInterrupted, msg: "archive interrupted. Resume with: " + p.command("archive")}
+		}
+		return err
+	})
+}
+
+// runs fn for each profile in turn. A failure stops a single profile as
+// usual, returning its error; with several, it is reported and the rest
+// still run, returning an exitError at the end. An exitError from fn,
+// like an interruption, stops at once
+func each(cfg config, profiles []profile, fn func(p profile) error) error {
+	if len(profiles) == 1 {
+		return fn(profiles[0])
 	}
+
+	status := 0
+	for _, p := range profiles {
+		err := fn(p)
+		var ee exitError
+		switch {
+		case err == nil:
+		case errors.As(err, &ee):
+			return ee
+		case errors.Is(err, eco.ErrReauthorize):
+			reauthRequired(cfg, p, err)
+			status = exitReauth
+		default:
+			fmt.Fprintf(os.Stderr, "profile %s: %v\n", p.Name, err)
+			if status == 0 {
+				status = 1
+			}
+		}
+	}
+	if status != 0 {
+		return exitError{code: status}
+	}
+	return nil
 }
 
-func archive(a *eco.App, start time.Time) error {
-	tty := tui.IsTTY(os.Stdout.Fd())
-	os.MkdirAll("archive", 0755) // nolint
-	client := elastic.New("http://estc:9200")
-	if !client.IndexExists(index) {
-		if err := client.CreateIndexFromFile(index, indexFile); err != nil {
-			return err
+// a problem with the command line rather than a failure
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// ends the program with an exit status, once msg (if any) is printed.
+// Commands return one rather than exiting themselves, so deferred cleanup
+// still runs
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e exitError) Error() string {
+	if e.msg == "" {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.msg
+}
+
+// exit status for a run cut short by SIGINT/SIGTERM, as shells report it
+const exitInterrupted = 130
+
+// exit status when ecobee no longer accepts the credentials, so cron jobs
+// and supervisors can tell it apart from other failures
+const exitReauth = 3
+
+// reports a fatal error. Lost authorization gets a clear explanation, the
+// configured webhook notification, and its own exit status
+func fail(cfg config, p profile, err error) {
+	var ue usageError
+	if errors.As(err, &ue) {
+		fmt.Fprintln(os.Stderr, ue)
+		os.Exit(1)
+	}
+	var ee exitError
+	if errors.As(err, &ee) {
+		if ee.msg != "" {
+			fmt.Fprintln(os.Stderr, ee.msg)
 		}
+		os.Exit(ee.code)
+	}
+	if !errors.Is(err, eco.ErrReauthorize) {
+		panic(err)
+	}
+	reauthRequired(cfg, p, err)
+	os.Exit(exitReauth)
+}
+
+func reauthRequired(cfg config, p profile, err error) {
+	fmt.Fprintf(os.Stderr, "%secobee authorization lost: %v\nRun %s to authorize again and resume\n", p.prefix(), err, p.command("reauth"))
+	if cfg.Notify.Webhook != "" {
+		if werr := notifyWebhook(cfg.Notify.Webhook, "reauthorization_required", p, err); werr != nil {
+			fmt.Fprintf(os.Stderr, "unable to notify webhook: %v\n", werr)
+		}
+	}
+}
+
+// returns a context cancelled on the first SIGINT/SIGTERM, asking work to
+// wrap up, and one cancelled on the second, aborting in-flight requests
+func signalContexts() (context.Context, context.Context) {
+	stop, cancelStop := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancelStop()
+		<-sigs
+		cancel()
+	}()
+	return stop, ctx
+}
+
+// archives runtime data in 20 day windows from start until today. Cancelling
+// stop lets the window in flight finish and saves progress before returning;
+// cancelling ctx aborts in-flight requests as well
+func archive(stop context.Context, ctx context.Context, p profile, a *eco.App, client elastic.Client, bulk elastic.BulkIndexerOptions, start time.Time) error {
+	tty := tui.IsTTY(os.Stdout.Fd())
+	dir := p.archiveDir()
+	os.MkdirAll(dir, 0755) // nolint
+	index := p.index()
+	created := func(what string) {
 		if tty {
-			fmt.Printf("index %s%s%s%s created\n", ansi.Bold, ansi.Magenta, index, ansi.Reset)
+			fmt.Printf("%s %s%s%s%s created\n", what, ansi.Bold, ansi.Magenta, index, ansi.Reset)
 		} else {
-			fmt.Printf("index %s created\n", index)
+			fmt.Printf("%s %s created\n", what, index)
 		}
 	}
+	switch {
+	case p.dataStream():
+		isNew, err := p.putDataStream(ctx, client)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			created("data stream")
+		}
+	case p.Period != "":
+		// indices are created as documents arrive for them
+		if err := p.checkAliasFree(ctx, client); err != nil {
+			return err
+		}
+		if err := p.putTemplate(ctx, client); err != nil {
+			return err
+		}
+	case !client.IndexExistsContext(ctx, index):
+		mapping, name, err := p.mapping()
+		if err != nil {
+			return err
+		}
+		if err := client.CreateIndexContext(ctx, index, bytes.NewReader(mapping)); err != nil {
+			return fmt.Errorf("creating index %s from %s: %w", index, name, err)
+		}
+		created("index")
+	}
 
 	w := ansi.NewWriter(os.Stdout)
 	if tty {
@@ -131,61 +436,46 @@ func archive(a *eco.App, start time.Time) error {
 
 	now := time.Now()
 	for t := start; t.Before(now.UTC().Truncate(24 * time.Hour)); t = t.AddDate(0, 0, 20) {
+		if stop.Err() != nil {
+			if err := a.Save(); err != nil {
+				return err
+			}
+			return stop.Err()
+		}
 		done := make(chan struct{})
 
 		if tty {
-			fmt.Printf("Date range %s%s%s%s -> %s%s%s%s\n  Fetching: \n  Transforming: \n  Sending: \n  Saving: ", ansi.Cyan, ansi.Bold, t.Format("2006-01-02"), ansi.Reset, ansi.Cyan, ansi.Bold, t.AddDate(0, 0, 19).Format("2006-01-02"), ansi.Reset)
-			w.Up(3)
-			w.Column(14)
-			go spin(done, w)
-		}
-		data, err := a.GetRuntimeData(t.Format("2006-01-02"), t.AddDate(0, 0, 19).Format("2006-01-02"))
-		if tty {
-			done <- struct{}{}
-		}
-		if err != nil {
-			return err
-		}
-		if tty {
-			w.Column(13)
-			fmt.Print(finished)
-			w.Down(1)
-			w.Column(18)
+			fmt.Printf("Date range %s%s%s%s -> %s%s%s%s\n  Streaming: \n  Saving: ", ansi.Cyan, ansi.Bold, t.Format("2006-01-02"), ansi.Reset, ansi.Cyan, ansi.Bold, t.AddDate(0, 0, 19).Format("2006-01-02"), ansi.Reset)
+			w.Up(1)
+			w.Column(15)
 			go spin(done, w)
 		}
-		nd, err := toNdJson(data)
+
+		file := filepath.Join(dir, t.Format("20060102")+"-"+t.AddDate(0, 0, 19).Format("20060102")+".json")
+		err := streamWindow(ctx, a, p, client, bulk, t.Format("2006-01-02"), t.AddDate(0, 0, 19).Format("2006-01-02"), file)
 		if tty {
 			done <- struct{}{}
 		}
 		if err != nil {
 			return err
 		}
-		if tty {
-			w.Column(17)
-			fmt.Print(finished)
-			w.Down(1)
-			w.Column(13)
-			go spin(done, w)
-		}
-
-		file := "archive/" + t.Format("20060102") + "-" + t.AddDate(0, 0, 19).Format("20060102") + ".json"
-		err = stream(nd, client, file)
-		if tty {
-			done <- struct{}{}
-		}
+		err = saveState(dir, archiveState{Next: t.AddDate(0, 0, 20).Format("2006-01-02")})
 		if err != nil {
 			return err
 		}
 		if tty {
-			w.Column(12)
+			w.Column(14)
 			fmt.Print(finished)
 			w.Down(1)
 			w.Column(11)
 			fmt.Print(finished)
 		}
-		time.Sleep(8 * time.Second)
+		select {
+		case <-stop.Done():
+		case <-time.After(windowPause):
+		}
 		if tty {
-			w.Up(4)
+			w.Up(2)
 			w.Column(36)
 			fmt.Print(": " + finished)
 			w.ClearDown()
@@ -194,6 +484,9 @@ func archive(a *eco.App, start time.Time) error {
 		}
 	}
 	fmt.Printf("archive done\n")
+	if cs := client.CompressionStats(); cs.BytesIn > 0 {
+		fmt.Printf("gzip: sent %.1f MB instead of %.1f MB, saving %.0f%%\n", float64(cs.BytesOut)/1e6, float64(cs.BytesIn)/1e6, 100*float64(cs.Saved())/float64(cs.BytesIn))
+	}
 	return nil
 }
 
@@ -213,40 +506,47 @@ func spin(done chan struct{}, w *ansi.Writer) {
 	}
 }
 
-func toNdJson(data eco.RuntimeData) (io.Reader, error) {
-	var buf bytes.Buffer
-	for _, d := range data.Data {
-		buf.WriteString("{\"index\":{}}\n")
-		ln, err := json.Marshal(d)
-		if err != nil {
-			return nil, err
-		}
-		buf.Write(ln)
-		buf.WriteRune('\n')
-	}
-
-	for _, d := range data.SensorData {
-		buf.WriteString("{\"index\":{}}\n")
-		ln, err := json.Marshal(d)
-		if err != nil {
-			return nil, err
-		}
-		buf.Write(ln)
-		buf.WriteRune('\n')
-	}
-	return &buf, nil
-}
-
-func stream(data io.Reader, client elastic.Client, file string) error {
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+// fetches one window of runtime data, handing documents to a bulk indexer
+// as they are decoded so the report is never held in memory. Each one is
+// also written to file, in the same form as the bulk requests
+func streamWindow(ctx context.Context, a *eco.App, p profile, client elastic.Client, bulk elastic.BulkIndexerOptions, from string, to string, file string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	tee := io.TeeReader(data, f)
+	w := bufio.NewWriter(f)
 
-	if err := client.Bulk(index, tee); err != nil {
-		return err
+	bulk.Index = p.index()
+	bi := client.NewBulkIndexer(ctx, bulk)
+	tags := p.tags()
+	err = a.StreamRuntimeDataContext(ctx, from, to, func(doc map[string]interface{}) error {
+		for k, v := range tags {
+			doc[k] = v
+		}
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		idx, err := p.docIndex(doc)
+		if err != nil {
+			return err
+		}
+		action, id := p.bulkAction(), p.docID(doc)
+		if idx == "" {
+			fmt.Fprintf(w, "{%q:{\"_id\":%q}}\n", action, id) // nolint: checked at Flush
+		} else {
+			fmt.Fprintf(w, "{%q:{\"_index\":%q,\"_id\":%q}}\n", action, idx, id) // nolint
+		}
+		w.Write(line)     // nolint
+		w.WriteByte('\n') // nolint
+		return bi.Add(ctx, elastic.BulkItem{Action: action, Index: idx, ID: id, Doc: json.RawMessage(line)})
+	})
+	if cerr := bi.Close(ctx); err == nil {
+		err = cerr
 	}
-	return nil
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return err
 }
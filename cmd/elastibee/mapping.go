@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pzl/elastibee/pkg/eco"
+	"github.com/pzl/elastibee/pkg/elastic"
+)
+
+// field types a kind of value can be stored under. Strings also go in
+// text fields with a keyword multi-field
+var kindTypes = map[string][]string{
+	eco.KindString:    {"keyword", "constant_keyword", "wildcard"},
+	eco.KindInteger:   {"integer", "long", "short", "byte", "unsigned_long", "float", "double", "half_float", "scaled_float"},
+	eco.KindFloat:     {"float", "double", "half_float", "scaled_float"},
+	eco.KindBoolean:   {"boolean"},
+	eco.KindTimestamp: {"date", "date_nanos"},
+	eco.KindDate:      {"date", "date_nanos"},
+	eco.KindTime:      {"date", "date_nanos"},
+}
+
+// date formats that parse each kind of date value. Empty is the default,
+// strict_date_optional_time||epoch_millis
+var kindFormats = map[string][]string{
+	eco.KindTimestamp: {"date_hour_minute_second", "strict_date_hour_minute_second", "date_optional_time", "strict_date_optional_time", "yyyy-MM-dd'T'HH:mm:ss", ""},
+	eco.KindDate:      {"date", "strict_date", "date_optional_time", "strict_date_optional_time", "yyyy-MM-dd", ""},
+	eco.KindTime:      {"hour_minute_second", "strict_hour_minute_second", "HH:mm:ss"},
+}
+
+// the mapping generated for each kind of field
+func kindMapping(kind string) map[string]interface{} {
+	switch kind {
+	case eco.KindInteger:
+		return map[string]interface{}{"type": "integer"}
+	case eco.KindFloat:
+		return map[string]interface{}{"type": "float"}
+	case eco.KindBoolean:
+		return map[string]interface{}{"type": "boolean"}
+	case eco.KindTimestamp:
+		return map[string]interface{}{"type": "date", "format": "date_hour_minute_second"}
+	case eco.KindDate:
+		return map[string]interface{}{"type": "date", "format": "date"}
+	case eco.KindTime:
+		return map[string]interface{}{"type": "date", "format": "hour_minute_second"}
+	}
+	return map[string]interface{}{"type": "keyword", "ignore_above": 256}
+}
+
+// every field archived documents can carry: what the runtime report
+// becomes, plus the profile tags
+func docFields() []eco.Field {
+	fields := eco.Fields()
+	for _, tag := range []string{"home", "profile"} {
+		fields = append(fields, eco.Field{Name: tag, Kind: eco.KindString, DocTypes: eco.DocTypes})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// what's wrong with how a mapping stores fields
+type mappingReport struct {
+	Missing   []eco.Field       // mapped dynamically, however the cluster guesses
+	Conflicts []string          // mapped as something that can't hold the values
+	Unused    []string          // mapped, but never sent
+	Renamed   map[string]string // missing field to the unused one mapped in its place, differing in case
+}
+
+func (r mappingReport) ok() bool {
+	return len(r.Missing) == 0 && len(r.Conflicts) == 0
+}
+
+// compares m with the fields documents carry. With want, the mapping the
+// fields should have, fields mapped as another type are conflicts too, as
+// those the cluster mapped dynamically usually are
+func checkMapping(fields []eco.Field, m elastic.Mappings, want elastic.Mappings) mappingReport {
+	var r mappingReport
+	emitted := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		emitted[f.Name] = true
+		fm, ok := m[f.Name]
+		if !ok {
+			r.Missing = append(r.Missing, f)
+			continue
+		}
+		if msg := conflict(f, fm); msg != "" {
+			r.Conflicts = append(r.Conflicts, f.Name+": "+msg)
+		} else if w, ok := want[f.Name]; ok && w.Type != fm.Type {
+			r.Conflicts = append(r.Conflicts, fmt.Sprintf("%s: mapped as %s rather than %s", f.Name, fm.Type, w.Type))
+		}
+	}
+	for name := range m {
+		if !emitted[name] {
+			r.Unused = append(r.Unused, name)
+		}
+	}
+	sort.Strings(r.Unused)
+	for _, f := range r.Missing {
+		for _, name := range r.Unused {
+			if strings.EqualFold(f.Name, name) && conflict(f, m[name]) == "" {
+				if r.Renamed == nil {
+					r.Renamed = make(map[string]string)
+				}
+				r.Renamed[f.Name] = name
+			}
+		}
+	}
+	return r
+}
+
+// why fm can't store the values of f, or empty when it can
+func conflict(f eco.Field, fm elastic.FieldMapping) string {
+	if f.Kind == eco.KindString && fm.Type == "text" {
+		for _, sub := range fm.Fields {
+			if sub == "keyword" {
+				return ""
+			}
+		}
+		return "mapped as text without a keyword field, so it can't be aggregated"
+	}
+	if !contains(kindTypes[f.Kind], fm.Type) {
+		return fmt.Sprintf("mapped as %s, but holds %s values", fm.Type, f.Kind)
+	}
+	formats, ok := kindFormats[f.Kind]
+	if !ok {
+		return ""
+	}
+	for _, format := range strings.Split(fm.Format, "||") {
+		if contains(formats, format) {
+			return ""
+		}
+	}
+	format := fm.Format
+	if format == "" {
+		format = "the default format"
+	}
+	return fmt.Sprintf("%s doesn't parse %s values", format, f.Kind)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// prints a report under a heading, returning whether it found problems
+func printMappingReport(heading string, r mappingReport) bool {
+	if r.ok() && len(r.Unused) == 0 {
+		fmt.Printf("%s: ok\n", heading)
+		return false
+	}
+	fmt.Printf("%s:\n", heading)
+	for _, f := range r.Missing {
+		if old, ok := r.Renamed[f.Name]; ok {
+			fmt.Printf("  %s: not mapped, so the cluster guesses a type for its %s values. %s is mapped instead\n", f.Name, f.Kind, old)
+			continue
+		}
+		fmt.Printf("  %s: not mapped, so the cluster guesses a type for its %s values\n", f.Name, f.Kind)
+	}
+	for _, c := range r.Conflicts {
+		fmt.Printf("  %s\n", c)
+	}
+	for _, name := range r.Unused {
+		fmt.Printf("  %s: mapped, but no document has it\n", name)
+	}
+	return !r.ok()
+}
+
+// compares the fields documents carry with the profile's mapping and with
+// the mapping of its index, if it has been created. Reports which needs
+// fixing
+func mappingCheck(ctx context.Context, p profile, client elastic.Client) (fileBad bool, indexBad bool, err error) {
+	fields := docFields()
+
+	data, name, err := p.mapping()
+	if err != nil {
+		return false, false, err
+	}
+	is, err := elastic.ParseIndexSettings(data)
+	if err != nil {
+		return false, false, fmt.Errorf("%s: %w", name, err)
+	}
+	m, err := elastic.ParseMappings(is.Mappings)
+	if err != nil {
+		return false, false, fmt.Errorf("%s: %w", name, err)
+	}
+	fileBad = printMappingReport(name, checkMapping(fields, m, nil))
+
+	index := p.index()
+	if !client.IndexExistsContext(ctx, index) {
+		fmt.Printf("index %s: not created yet\n", index)
+		return fileBad, false, nil
+	}
+	all, err := client.MappingContext(ctx, index)
+	if err != nil {
+		return fileBad, false, err
+	}
+	corrected, err := correctedMapping(data, name)
+	if err != nil {
+		return fileBad, false, err
+	}
+	var cs elastic.IndexSettings
+	if err := json.Unmarshal(corrected, &cs); err != nil {
+		return fileBad, false, err
+	}
+	want, err := elastic.ParseMappings(cs.Mappings)
+	if err != nil {
+		return fileBad, false, err
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		heading := "index " + name
+		if name != index {
+			heading += " (" + index + ")"
+		}
+		if printMappingReport(heading, checkMapping(fields, all[name], want)) {
+			indexBad = true
+		}
+	}
+	return fileBad, indexBad, nil
+}
+
+// rewrites a mapping with every emitted field mapped to suit its values:
+// missing ones are added, conflicting ones replaced and unused ones
+// dropped. A field mapped under the wrong case is renamed, keeping its
+// definition. Everything else is kept
+func correctedMapping(data []byte, name string) ([]byte, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	is, err := elastic.ParseIndexSettings(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	m, err := elastic.ParseMappings(is.Mappings)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	mappings, _ := body["mappings"].(map[string]interface{})
+	if mappings == nil {
+		mappings = make(map[string]interface{})
+		body["mappings"] = mappings
+	}
+	props, _ := mappings["properties"].(map[string]interface{})
+	if props == nil {
+		props = make(map[string]interface{})
+		mappings["properties"] = props
+	}
+
+	r := checkMapping(docFields(), m, nil)
+	renamed := make(map[string]interface{}, len(r.Renamed))
+	for name, old := range r.Renamed {
+		renamed[name] = getField(props, old)
+	}
+	for _, name := range r.Unused {
+		deleteField(props, name)
+	}
+	for _, f := range docFields() {
+		fm, ok := m[f.Name]
+		switch {
+		case !ok && renamed[f.Name] != nil:
+			setField(props, f.Name, renamed[f.Name])
+		case !ok || conflict(f, fm) != "":
+			setField(props, f.Name, kindMapping(f.Kind))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeMapping(&buf, body, "", false); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// writes v as indented JSON, with object keys sorted, the way mapping files
+// are laid out: type leads field definitions, but not lists of fields
+func writeMapping(buf *bytes.Buffer, v interface{}, indent string, typeFirst bool) error {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		data, err := json.Marshal(v)
+		buf.Write(data)
+		return err
+	}
+	if len(obj) == 0 {
+		buf.WriteString("{}")
+		return nil
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if typeFirst && (keys[i] == "type" || keys[j] == "type") {
+			return keys[i] == "type"
+		}
+		return keys[i] < keys[j]
+	})
+	buf.WriteString("{\n")
+	for i, k := range keys {
+		name, _ := json.Marshal(k)
+		buf.WriteString(indent + "\t")
+		buf.Write(name)
+		buf.WriteString(": ")
+		if err := writeMapping(buf, obj[k], indent+"\t", k != "properties" && k != "fields"); err != nil {
+			return err
+		}
+		if i < len(keys)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(indent + "}")
+	return nil
+}
+
+// the definition at a dotted field name, or nil
+func getField(props map[string]interface{}, name string) interface{} {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 1 {
+		return props[name]
+	}
+	obj, _ := props[parts[0]].(map[string]interface{})
+	sub, _ := obj["properties"].(map[string]interface{})
+	if sub == nil {
+		return nil
+	}
+	return getField(sub, parts[1])
+}
+
+// puts def at a dotted field name, making object fields on the way
+func setField(props map[string]interface{}, name string, def interface{}) {
+	parts := strings.Split(name, ".")
+	for _, part := range parts[:len(parts)-1] {
+		obj, _ := props[part].(map[string]interface{})
+		if obj == nil {
+			obj = make(map[string]interface{})
+			props[part] = obj
+		}
+		sub, _ := obj["properties"].(map[string]interface{})
+		if sub == nil {
+			sub = make(map[string]interface{})
+			obj["properties"] = sub
+		}
+		props = sub
+	}
+	props[parts[len(parts)-1]] = def
+}
+
+// removes a dotted field name, and any object fields left empty
+func deleteField(props map[string]interface{}, name string) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 1 {
+		delete(props, name)
+		return
+	}
+	obj, _ := props[parts[0]].(map[string]interface{})
+	sub, _ := obj["properties"].(map[string]interface{})
+	if sub == nil {
+		return
+	}
+	deleteField(sub, parts[1])
+	if len(sub) == 0 {
+		delete(props, parts[0])
+	}
+}
+
+// runs a mapping subcommand: check; generate [file] to print the corrected
+// mapping or write it to file; or print, for the mapping in effect
+func mappingCommand(ctx context.Context, cfg config, p profile, args []string) error {
+	if len(args) == 0 {
+		return usageError("parameter expected: check, generate or print")
+	}
+	switch args[0] {
+	case "check":
+		client, err := cfg.Elastic.client()
+		if err != nil {
+			return err
+		}
+		fileBad, indexBad, err := mappingCheck(ctx, p, client)
+		if err != nil {
+			return err
+		}
+		if fileBad && p.Mapping != "" {
+			fmt.Printf("correct the mapping file with: %s\n", p.command("mapping generate "+p.Mapping))
+		} else if fileBad {
+			fmt.Printf("write a corrected mapping with %s, and set \"mapping\" in the config to use it\n", p.command("mapping generate mapping.json"))
+		}
+		if indexBad && (p.dataStream() || p.Period != "") {
+			fmt.Println("indices keep their mapping: new ones made from the corrected template will have it")
+		} else if indexBad {
+			fmt.Printf("an index keeps its mapping: once the file is correct, move the documents into a new index with: %s\n", p.command("migrate"))
+		}
+		if fileBad || indexBad {
+			return exitError{code: 1}
+		}
+		return nil
+	case "generate":
+		data, name, err := p.mapping()
+		if err != nil {
+			return err
+		}
+		out, err := correctedMapping(data, name)
+		if err != nil {
+			return err
+		}
+		if len(args) >= 2 {
+			return ioutil.WriteFile(args[1], out, 0644)
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	case "print":
+		data, _, err := p.mapping()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return usageError(fmt.Sprintf("unknown mapping command %q. Use check, generate or print", args[0]))
+}
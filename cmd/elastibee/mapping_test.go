@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pzl/elastibee/etc"
+	"github.com/pzl/elastibee/pkg/elastic"
+	"github.com/pzl/elastibee/pkg/elastic/elastictest"
+)
+
+func TestMappingCheckStatus(t *testing.T) {
+	inTempDir(t)
+	// every field but the outdoor temperature mapped
+	if err := os.WriteFile("partial.json", []byte(strings.Replace(string(etc.Mapping), `"outdoorTemp": {`, `"outdoorTemp_": {`, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mapping string // file, or the built-in one
+		index   string // the index's creation body, if it exists
+		status  int
+	}{
+		{"built-in, no index yet", "", "", 0},
+		{"built-in, index created from it", "", string(etc.Mapping), 0},
+		{"file missing a field", "partial.json", "", 1},
+		{"index missing a field", "", `{"mappings":{"properties":{"@timestamp":{"type":"date"}}}}`, 1},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srv := elastictest.NewServer()
+			defer srv.Close()
+			ctx := context.Background()
+			if tc.index != "" {
+				if err := elastic.New(srv.URL).CreateIndexContext(ctx, defaultIndex, strings.NewReader(tc.index)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := config{Elastic: elasticConfig{URL: srv.URL}}
+			p := profile{profileConfig: profileConfig{Mapping: tc.mapping}}
+
+			// reported through the error, rather than exiting from within
+			err := mappingCommand(ctx, cfg, p, []string{"check"})
+			var ee exitError
+			switch {
+			case tc.status == 0 && err != nil:
+				t.Fatalf("expected the check to pass, got %v", err)
+			case tc.status != 0 && (!errors.As(err, &ee) || ee.code != tc.status):
+				t.Fatalf("expected exit status %d, got %v", tc.status, err)
+			}
+		})
+	}
+}
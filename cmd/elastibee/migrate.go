@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pzl/elastibee/pkg/elastic"
+)
+
+// moves the profile's documents into a new index created from the current
+// mapping, then points the index name at it as an alias. The old index is
+// made read-only first so nothing is written to it meanwhile, and the swap
+// only happens once the new one holds every document
+func migrate(ctx context.Context, p profile, client elastic.Client, script string, pipeline string) error {
+	if p.dataStream() || p.Period != "" {
+		return usageError("migrate works on a single index. Time-based indices and data streams take up mapping changes from their template with the next period or rollover")
+	}
+	index := p.index()
+
+	aliased, err := client.AliasIndicesContext(ctx, index)
+	if err != nil {
+		return err
+	}
+	var src string
+	switch len(aliased) {
+	case 0:
+		if !client.IndexExistsContext(ctx, index) {
+			return fmt.Errorf("index %s doesn't exist. archive creates it from the current mapping", index)
+		}
+		src = index
+	case 1:
+		src = aliased[0]
+	default:
+		return fmt.Errorf("alias %s covers several indices, %v. migrate moves one", index, aliased)
+	}
+	dest := nextVersion(index, src)
+	if client.IndexExistsContext(ctx, dest) {
+		return fmt.Errorf("index %s already exists, likely from a migration that didn't finish. Delete it and try again", dest)
+	}
+
+	mapping, name, err := p.mapping()
+	if err != nil {
+		return err
+	}
+	if err := client.CreateIndexContext(ctx, dest, bytes.NewReader(mapping)); err != nil {
+		return fmt.Errorf("creating index %s from %s: %w", dest, name, err)
+	}
+	fmt.Printf("index %s created\n", dest)
+
+	if err := client.PutSettingsContext(ctx, src, map[string]interface{}{"index.blocks.write": true}); err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if swapped {
+			return
+		}
+		if err := client.PutSettingsContext(context.Background(), src, map[string]interface{}{"index.blocks.write": false}); err != nil {
+			fmt.Printf("unable to make %s writable again: %v\n", src, err)
+		}
+		fmt.Printf("%s is unchanged. %s is left for inspection; delete it before trying again\n", src, dest)
+	}()
+
+	if err := client.RefreshContext(ctx, src); err != nil {
+		return err
+	}
+	want, err := client.CountContext(ctx, src)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("reindexing %d documents from %s\n", want, src)
+	res, err := client.ReindexContext(ctx, elastic.Reindex{Source: src, Dest: dest, Script: script, Pipeline: pipeline})
+	if err != nil {
+		return err
+	}
+	if err := client.RefreshContext(ctx, dest); err != nil {
+		return err
+	}
+	got, err := client.CountContext(ctx, dest)
+	if err != nil {
+		return err
+	}
+	// a script may skip or delete documents on purpose
+	if got != want-res.Noops-res.Deleted {
+		return fmt.Errorf("%s has %d documents, but %s has %d (%d skipped and %d deleted by the script)", src, want, dest, got, res.Noops, res.Deleted)
+	}
+
+	actions := []elastic.AliasAction{{Add: &elastic.AliasTarget{Index: dest, Alias: index}}}
+	if src == index {
+		// an alias can't share a name with an index, so the old one goes
+		// in the same step
+		actions = append([]elastic.AliasAction{{RemoveIndex: &elastic.AliasTarget{Index: src}}}, actions...)
+	} else {
+		actions = append(actions, elastic.AliasAction{Remove: &elastic.AliasTarget{Index: src, Alias: index}})
+	}
+	if err := client.UpdateAliasesContext(ctx, actions...); err != nil {
+		return err
+	}
+	swapped = true
+
+	fmt.Printf("%s now points to %s, holding %d documents", index, dest, got)
+	if res.Noops > 0 || res.Deleted > 0 {
+		fmt.Printf(" (%d skipped and %d deleted by the script)", res.Noops, res.Deleted)
+	}
+	fmt.Println()
+	if src == index {
+		fmt.Printf("index %s was replaced\n", src)
+	} else {
+		fmt.Printf("%s is kept, read-only. Delete it once satisfied\n", src)
+	}
+	return nil
+}
+
+// the versioned name following src: index-v1 after the original index,
+// then index-v2 and so on
+func nextVersion(index string, src string) string {
+	if v := strings.TrimPrefix(src, index+"-v"); v != src {
+		if n, err := strconv.Atoi(v); err == nil {
+			return index + "-v" + strconv.Itoa(n+1)
+		}
+	}
+	return index + "-v1"
+}
+
+// parses the migrate command line: [-script file] [-pipeline name]
+func migrateCommand(ctx context.Context, cfg config, p profile, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	scriptFile := fs.String("script", "", "file holding a painless script run on each document, such as to rename fields")
+	pipeline := fs.String("pipeline", "", "ingest pipeline to send documents through")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return usageError(err.Error())
+	}
+
+	var script string
+	if *scriptFile != "" {
+		data, err := ioutil.ReadFile(*scriptFile)
+		if err != nil {
+			return err
+		}
+		script = string(data)
+	}
+	client, err := cfg.Elastic.client()
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, p, client, script, *pipeline)
+}
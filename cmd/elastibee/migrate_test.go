@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pzl/elastibee/pkg/elastic"
+	"github.com/pzl/elastibee/pkg/elastic/elastictest"
+)
+
+// an Elasticsearch fake with index eco holding n documents, alternating
+// between the two types
+func migrateFake(t *testing.T, n int) (*elastictest.Server, elastic.Client) {
+	t.Helper()
+	srv := elastictest.NewServer()
+	t.Cleanup(srv.Close)
+	client := elastic.New(srv.URL)
+	ctx := context.Background()
+	if err := client.CreateIndexContext(ctx, defaultIndex, strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		typ := []string{"thermostat", "sensor"}[i%2]
+		fmt.Fprintf(&b, "{\"index\":{\"_id\":\"%d\"}}\n{\"type\":%q,\"n\":%d}\n", i, typ, i)
+	}
+	if err := client.BulkContext(ctx, defaultIndex, strings.NewReader(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+func TestMigrate(t *testing.T) {
+	srv, client := migrateFake(t, 10)
+	ctx := context.Background()
+
+	// the first migration replaces the index with an alias of its name
+	if err := migrate(ctx, profile{}, client, "", ""); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if srv.Index(defaultIndex) != nil {
+		t.Errorf("original index %s was not replaced", defaultIndex)
+	}
+	v1 := srv.Index(defaultIndex + "-v1")
+	if v1 == nil || len(v1.Docs) != 10 || fmt.Sprint(v1.Aliases) != "["+defaultIndex+"]" {
+		t.Fatalf("expected %s-v1 holding 10 documents behind alias %s, got %+v", defaultIndex, defaultIndex, v1)
+	}
+	if len(v1.Settings) == 0 {
+		t.Errorf("%s-v1 was not created from the mapping", defaultIndex)
+	}
+
+	// later ones move the alias on, keeping the previous version read-only
+	if err := migrate(ctx, profile{}, client, "", ""); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	if aliased, err := client.AliasIndicesContext(ctx, defaultIndex); err != nil || fmt.Sprint(aliased) != "["+defaultIndex+"-v2]" {
+		t.Errorf("alias %s covers %v, %v; expected just %s-v2", defaultIndex, aliased, err, defaultIndex)
+	}
+	v1 = srv.Index(defaultIndex + "-v1")
+	if v1 == nil || !v1.WriteBlocked || len(v1.Aliases) != 0 {
+		t.Errorf("expected %s-v1 kept read-only outside the alias, got %+v", defaultIndex, v1)
+	}
+	if n := len(srv.Docs(defaultIndex)); n != 10 {
+		t.Errorf("alias %s reads %d documents, expected 10", defaultIndex, n)
+	}
+}
+
+func TestMigrateScriptSkips(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		op     string
+	}{
+		{"noop", "if (ctx._source.type == 'sensor') { ctx.op = 'noop' }", "noop"},
+		{"delete", "if (ctx._source.type == 'sensor') { ctx.op = 'delete' }", "delete"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srv, client := migrateFake(t, 10)
+			srv.ReindexScript = func(script string, doc map[string]interface{}) (map[string]interface{}, string) {
+				if doc["type"] == "sensor" {
+					return doc, tc.op
+				}
+				return doc, "index"
+			}
+
+			// the documents the script leaves out aren't taken for lost ones
+			if err := migrate(context.Background(), profile{}, client, tc.script, ""); err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+			if n := len(srv.Docs(defaultIndex)); n != 5 {
+				t.Errorf("alias %s reads %d documents, expected the 5 thermostat ones", defaultIndex, n)
+			}
+		})
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	srv, client := migrateFake(t, 10)
+	srv.ReindexFailure = func(doc map[string]interface{}) *elastictest.ItemError {
+		if doc["n"].(float64) == 3 {
+			return &elastictest.ItemError{Type: "mapper_parsing_exception", Reason: "failed to parse field [n]"}
+		}
+		return nil
+	}
+	ctx := context.Background()
+
+	if err := migrate(ctx, profile{}, client, "", ""); err == nil {
+		t.Fatal("expected the failed reindex to stop the migration")
+	}
+	// left as it was, and writable again
+	ix := srv.Index(defaultIndex)
+	if ix == nil || ix.WriteBlocked || len(ix.Docs) != 10 {
+		t.Fatalf("expected %s writable with its 10 documents, got %+v", defaultIndex, ix)
+	}
+	if aliased, err := client.AliasIndicesContext(ctx, defaultIndex); err != nil || len(aliased) != 0 {
+		t.Errorf("alias %s created despite the failure: %v, %v", defaultIndex, aliased, err)
+	}
+	// the partial copy is kept for inspection, and blocks another try
+	// until deleted
+	if v1 := srv.Index(defaultIndex + "-v1"); v1 == nil || len(v1.Docs) != 9 {
+		t.Errorf("expected the partial %s-v1 to be kept, got %+v", defaultIndex, v1)
+	}
+	srv.ReindexFailure = nil
+	if err := migrate(ctx, profile{}, client, "", ""); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected the leftover %s-v1 to stop another migration, got %v", defaultIndex, err)
+	}
+	if ix := srv.Index(defaultIndex); ix == nil || ix.WriteBlocked {
+		t.Errorf("%s was touched by the refused migration: %+v", defaultIndex, ix)
+	}
+}
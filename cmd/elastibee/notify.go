@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// posts a JSON event about err in profile to url
+func notifyWebhook(url string, event string, p profile, err error) error {
+	host, _ := os.Hostname() // nolint: best effort
+	body, merr := json.Marshal(map[string]string{
+		"event":   event,
+		"error":   err.Error(),
+		"profile": p.Name,
+		"home":    p.Home,
+		"host":    host,
+		"time":    time.Now().Format(time.RFC3339),
+	})
+	if merr != nil {
+		return merr
+	}
+
+	c := &http.Client{Timeout: 10 * time.Second}
+	res, perr := c.Post(url, "application/json", bytes.NewReader(body))
+	if perr != nil {
+		return perr
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return nil
+}
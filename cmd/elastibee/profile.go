@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pzl/elastibee/etc"
+	"github.com/pzl/elastibee/pkg/api"
+	"github.com/pzl/elastibee/pkg/auth"
+	"github.com/pzl/elastibee/pkg/eco"
+	"github.com/pzl/elastibee/pkg/elastic"
+)
+
+// selects every profile for commands that can run on several
+const allProfiles = "all"
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// one ecobee account, and where its data goes
+type profile struct {
+	Name string // empty for a config without profiles
+	profileConfig
+}
+
+// returns the profiles sel picks: a name, "all", or "" for the only one
+// configured. A config without profiles has just the unnamed one, made
+// of the top-level settings
+func (cfg config) profiles(sel string) ([]profile, error) {
+	if len(cfg.Profiles) == 0 {
+		if sel != "" && sel != allProfiles {
+			return nil, fmt.Errorf("no profile %q: the config doesn't define any profiles", sel)
+		}
+		return []profile{{profileConfig: cfg.profileConfig}}, nil
+	}
+
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch sel {
+	case "":
+		if len(names) > 1 {
+			return nil, fmt.Errorf("several profiles are configured (%v). Pick one with -profile, or -profile %s", names, allProfiles)
+		}
+		sel = names[0]
+	case allProfiles:
+		ps := make([]profile, 0, len(names))
+		for _, name := range names {
+			ps = append(ps, cfg.profile(name))
+		}
+		return ps, nil
+	}
+	if _, ok := cfg.Profiles[sel]; !ok {
+		return nil, fmt.Errorf("no profile %q in the config. Have: %v", sel, names)
+	}
+	return []profile{cfg.profile(sel)}, nil
+}
+
+// settings a named profile leaves out come from the top level, apart from
+// the store, which defaults to a file of its own
+func (cfg config) profile(name string) profile {
+	p := profile{Name: name, profileConfig: cfg.Profiles[name]}
+	if p.Scope == "" {
+		p.Scope = cfg.Scope
+	}
+	if p.Index == "" {
+		p.Index = cfg.Index
+	}
+	if p.Mapping == "" {
+		p.Mapping = cfg.Mapping
+	}
+	if p.Period == "" {
+		p.Period = cfg.Period
+	}
+	if p.DataStream == nil {
+		p.DataStream = cfg.DataStream
+	}
+	if p.Lifecycle == nil && p.dataStream() {
+		p.Lifecycle = cfg.Lifecycle // only meaningful for a data stream
+	}
+	return p
+}
+
+func (cfg config) validate() error {
+	if err := cfg.profileConfig.validate(); err != nil {
+		return err
+	}
+	for name, pc := range cfg.Profiles {
+		if !profileName.MatchString(name) || name == allProfiles {
+			return fmt.Errorf("invalid profile name %q: use letters, digits, - and _", name)
+		}
+		if err := pc.validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	// combinations are checked once profiles have their inherited settings
+	ps, _ := cfg.profiles(allProfiles) // nolint: only fails on a bad selection
+	for _, p := range ps {
+		var err error
+		switch {
+		case p.Period != "" && p.dataStream():
+			err = errors.New("period and data_stream can't be used together: a data stream rolls over by itself")
+		case p.Lifecycle != nil && !p.dataStream():
+			err = errors.New("lifecycle is only applied to a data stream. Set data_stream")
+		}
+		if err != nil && p.Name != "" {
+			return fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc profileConfig) validate() error {
+	if pc.Scope != "" {
+		if err := auth.ValidScope(pc.Scope); err != nil {
+			return err
+		}
+	}
+	if pc.Period != "" {
+		if _, err := elastic.TimeSuffix(pc.Period, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whether the profile archives into a data stream
+func (p profile) dataStream() bool {
+	return p.DataStream != nil && *p.DataStream
+}
+
+func (p profile) index() string {
+	if p.Index == "" {
+		return defaultIndex
+	}
+	return p.Index
+}
+
+// the time-based index doc belongs in, from its type and @timestamp.
+// Empty when the profile archives into a single index
+func (p profile) docIndex(doc map[string]interface{}) (string, error) {
+	if p.Period == "" {
+		return "", nil
+	}
+	typ, _ := doc["type"].(string)
+	ts, _ := doc["@timestamp"].(string)
+	t, err := time.Parse("2006-01-02T15:04:05", ts)
+	if err != nil {
+		return "", fmt.Errorf("routing document to an index: %w", err)
+	}
+	suffix, err := elastic.TimeSuffix(p.Period, t)
+	if err != nil {
+		return "", err
+	}
+	return p.index() + "-" + typ + "-" + suffix, nil
+}
+
+// installs the index template time-based indices are created from, which
+// also puts each in the read alias. For a data stream, it matches just the
+// stream, under the lifecycle policy if there is one
+func (p profile) putTemplate(ctx context.Context, client elastic.Client) error {
+	data, name, err := p.mapping()
+	if err != nil {
+		return err
+	}
+	is, err := elastic.ParseIndexSettings(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	index := p.index()
+	t := elastic.IndexTemplate{Template: is}
+	if p.dataStream() {
+		t.IndexPatterns = []string{index}
+		t.DataStream = &elastic.DataStreamTemplate{}
+		t.Template.Aliases = nil
+		if p.Lifecycle != nil {
+			if err := t.Template.Set("index.lifecycle.name", index); err != nil {
+				return fmt.Errorf("%s: settings: %w", name, err)
+			}
+		}
+		return client.PutIndexTemplateContext(ctx, index, t)
+	}
+	t.Template.Aliases = map[string]json.RawMessage{index: json.RawMessage(`{}`)}
+	for _, typ := range eco.DocTypes {
+		t.IndexPatterns = append(t.IndexPatterns, index+"-"+typ+"-*")
+	}
+	return client.PutIndexTemplateContext(ctx, index, t)
+}
+
+// fails when index is a plain index. Time-based indices join an alias of
+// that name, which Elasticsearch would refuse to create for each of them
+func (p profile) checkAliasFree(ctx context.Context, client elastic.Client) error {
+	index := p.index()
+	aliased, err := client.AliasIndicesContext(ctx, index)
+	if err != nil {
+		return err
+	}
+	if len(aliased) > 0 {
+		return nil
+	}
+	exists, err := client.HasIndexContext(ctx, index)
+	if err != nil || !exists {
+		return err
+	}
+	return fmt.Errorf("index %s exists, and time-based indices need its name for their alias. Remove period and run %s to put the index behind an alias, or delete index %s", index, p.command("migrate"), index)
+}
+
+// sets up the data stream, its template and lifecycle policy, reporting
+// whether the stream had to be created
+func (p profile) putDataStream(ctx context.Context, client elastic.Client) (bool, error) {
+	index := p.index()
+	if p.Lifecycle != nil {
+		if err := client.PutLifecyclePolicyContext(ctx, index, p.Lifecycle.policy()); err != nil {
+			return false, err
+		}
+	}
+	if err := p.putTemplate(ctx, client); err != nil {
+		return false, err
+	}
+	if client.DataStreamExistsContext(ctx, index) {
+		return false, nil
+	}
+	return true, client.CreateDataStreamContext(ctx, index)
+}
+
+// the _id of doc: the same reading from the same thermostat or sensor
+// always gets the same one, so archiving a window again overwrites rather
+// than duplicates it
+func (p profile) docID(doc map[string]interface{}) string {
+	var sensor string
+	if s, ok := doc["sensor"].(map[string]string); ok {
+		sensor = s["id"]
+	}
+	thermostat, _ := doc["thermostat"].(string)
+	typ, _ := doc["type"].(string)
+	ts, _ := doc["@timestamp"].(string)
+	sum := sha1.Sum([]byte(strings.Join([]string{p.Name, thermostat, typ, sensor, ts}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// the bulk action documents are written with. Data streams only take create
+func (p profile) bulkAction() string {
+	if p.dataStream() {
+		return "create"
+	}
+	return "index"
+}
+
+// the settings and mappings indices are created with: the configured file,
+// or else the built-in mapping. name describes which for messages
+func (p profile) mapping() (data []byte, name string, err error) {
+	if p.Mapping == "" {
+		return etc.Mapping, builtinMapping, nil
+	}
+	data, err = ioutil.ReadFile(p.Mapping)
+	return data, p.Mapping, err
+}
+
+// where windows and progress are written: archive/, or archive/<name>/
+// for named profiles
+func (p profile) archiveDir() string {
+	if p.Name == "" {
+		return "archive"
+	}
+	return filepath.Join("archive", p.Name)
+}
+
+// fields added to every document, telling apart data from several homes
+// sharing an index
+func (p profile) tags() map[string]string {
+	tags := make(map[string]string)
+	if p.Name != "" {
+		tags["profile"] = p.Name
+	}
+	if p.Home != "" {
+		tags["home"] = p.Home
+	} else if p.Name != "" {
+		tags["home"] = p.Name
+	}
+	return tags
+}
+
+// a command line running cmd for this profile, for hints in messages
+func (p profile) command(cmd string) string {
+	if p.Name == "" {
+		return os.Args[0] + " " + cmd
+	}
+	return os.Args[0] + " -profile " + p.Name + " " + cmd
+}
+
+// leads messages about a named profile
+func (p profile) prefix() string {
+	if p.Name == "" {
+		return ""
+	}
+	return "profile " + p.Name + ": "
+}
+
+func (p profile) store() (eco.TokenStore, error) {
+	return p.Store.open(eco.ProfilePath(p.Name))
+}
+
+// opens the profile's app ready for running cmd, warning about tokens
+// that need attention
+func (p profile) open(cmd string) (*eco.App, error) {
+	store, err := p.store()
+	if err != nil {
+		return nil, err
+	}
+	a, err := eco.OpenStore(store)
+	if errors.Is(err, os.ErrNotExist) && p.Name != "" {
+		return nil, fmt.Errorf("profile %s has no app yet. Run: %s", p.Name, p.command("init <app key>"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// ECOBEE_API_URL points everything at another server, such as a mock.
+	// Proxies are taken from HTTP_PROXY/HTTPS_PROXY
+	c, err := api.New(api.Options{
+		BaseURL:   os.Getenv("ECOBEE_API_URL"),
+		UserAgent: "elastibee",
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.SetAPI(c)
+
+	switch {
+	case p.Scope == "" || p.Scope == a.Scope:
+	case cmd == "pin" || cmd == "authorize" || cmd == "reauth":
+		a.Scope = p.Scope // ask for the configured scope this time
+	default:
+		if err := a.CheckScope(p.Scope); err != nil {
+			return nil, fmt.Errorf("%w. Run %s to authorize for just %s", err, p.command("pin"), p.Scope)
+		}
+	}
+
+	if exp, soon := a.RefreshExpiresSoon(); soon {
+		fmt.Fprintf(os.Stderr, "warning: ecobee refresh token expires from inactivity around %s. Run %s to keep it alive\n", exp.Format("2006-01-02"), p.command("refresh"))
+	}
+	return a, nil
+}
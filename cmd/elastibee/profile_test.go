@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestProfileDataStreamOverride(t *testing.T) {
+	var cfg config
+	err := json.Unmarshal([]byte(`{
+		"data_stream": true,
+		"lifecycle": {"delete_after": "365d"},
+		"profiles": {
+			"cabin": {},
+			"home": {"data_stream": false}
+		}
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	cabin, home := cfg.profile("cabin"), cfg.profile("home")
+	if !cabin.dataStream() || cabin.Lifecycle == nil {
+		t.Errorf("cabin should inherit the data stream and its lifecycle: %v, %v", cabin.dataStream(), cabin.Lifecycle)
+	}
+	if home.dataStream() || home.Lifecycle != nil {
+		t.Errorf("home turned the data stream off: %v, %v", home.dataStream(), home.Lifecycle)
+	}
+	if home.bulkAction() != "index" {
+		t.Errorf("home writes with %s, expected index", home.bulkAction())
+	}
+}
+
+func TestEach(t *testing.T) {
+	ps := []profile{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	var ran []string
+	err := each(config{}, ps, func(p profile) error {
+		ran = append(ran, p.Name)
+		if p.Name == "a" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	var ee exitError
+	if !errors.As(err, &ee) || ee.code != 1 {
+		t.Errorf("expected exit status 1 after a failure, got %v", err)
+	}
+	if len(ran) != 3 {
+		t.Errorf("a failure stopped the other profiles: ran %v", ran)
+	}
+
+	ran = nil
+	err = each(config{}, ps, func(p profile) error {
+		ran = append(ran, p.Name)
+		return exitError{code: exitInterrupted}
+	})
+	if !errors.As(err, &ee) || ee.code != exitInterrupted {
+		t.Errorf("expected the interruption back, got %v", err)
+	}
+	if len(ran) != 1 {
+		t.Errorf("profiles ran after an interruption: %v", ran)
+	}
+
+	// a single profile's error comes back as is
+	failed := errors.New("failed")
+	if err := each(config{}, ps[:1], func(p profile) error { return failed }); err != failed {
+		t.Errorf("expected the profile's own error, got %v", err)
+	}
+}
+
+func TestDocID(t *testing.T) {
+	p := profile{Name: "home"}
+	doc := func(thermostat string, sensor string) map[string]interface{} {
+		d := map[string]interface{}{"@timestamp": "2020-02-01T00:05:00", "type": "sensor", "thermostat": thermostat}
+		if sensor != "" {
+			d["sensor"] = map[string]string{"id": sensor}
+		}
+		return d
+	}
+
+	if p.docID(doc("311000000001", "ei:0")) != p.docID(doc("311000000001", "ei:0")) {
+		t.Error("the same reading got different IDs")
+	}
+	// every thermostat's own sensor is ei:0
+	if p.docID(doc("311000000001", "ei:0")) == p.docID(doc("311000000002", "ei:0")) {
+		t.Error("two thermostats' readings share an ID")
+	}
+	if p.docID(doc("311000000001", "ei:0")) == (profile{Name: "cabin"}).docID(doc("311000000001", "ei:0")) {
+		t.Error("two profiles' readings share an ID")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pzl/elastibee/pkg/eco"
+)
+
+const stateFile = "state.json"
+
+// archive progress, so an interrupted or failed archive can pick up where
+// it left off
+type archiveState struct {
+	Next string `json:"next"` // start date of the next window to archive
+}
+
+// progress is kept in each profile's archive directory
+func loadState(dir string) (archiveState, error) {
+	var st archiveState
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+// replaced atomically, so a crash mid-write can't lose the progress made
+func saveState(dir string, st archiveState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return eco.WriteFileAtomic(filepath.Join(dir, stateFile), data)
+}
@@ -0,0 +1,10 @@
+// Package etc holds the index mapping compiled into elastibee, so it runs
+// from any directory
+package etc
+
+import _ "embed" // for go:embed
+
+// Mapping is the default index mapping, mapping.json
+//
+//go:embed mapping.json
+var Mapping []byte
@@ -1,5 +1,15 @@
 module github.com/pzl/elastibee
 
-go 1.13
+go 1.18
 
-require github.com/pzl/tui v0.0.0-20190521191055-69e1f70e5c29
+require (
+	github.com/pzl/tui v0.0.0-20190521191055-69e1f70e5c29
+	golang.org/x/crypto v0.17.0
+)
+
+require (
+	github.com/mattn/go-isatty v0.0.7 // indirect
+	github.com/mattn/go-runewidth v0.0.4 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/term v0.15.0 // indirect
+)
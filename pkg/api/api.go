@@ -0,0 +1,171 @@
+// Package api holds the connection settings shared by the auth and eco
+// packages when talking to ecobee
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultBaseURL = "https://api.ecobee.com"
+
+// generous, since ecobee servers are occasionally... sluggish
+const DefaultTimeout = 90 * time.Second
+
+// for connecting, and again for the TLS handshake
+const connectTimeout = 30 * time.Second
+
+type Options struct {
+	BaseURL    string        // defaults to DefaultBaseURL
+	HTTPClient *http.Client  // used as-is when set, ignoring Timeout and Proxy
+	UserAgent  string        // sent on every request when set
+	Timeout    time.Duration // for the response to start, and for each read of its body. Defaults to DefaultTimeout
+	Proxy      string        // proxy URL. Defaults to HTTP_PROXY/HTTPS_PROXY from the environment
+}
+
+type Client struct {
+	BaseURL     string
+	UserAgent   string
+	HTTP        *http.Client
+	IdleTimeout time.Duration // longest wait for more of a response body. Zero waits on the request's context alone
+}
+
+func New(o Options) (*Client, error) {
+	c := &Client{
+		BaseURL:   strings.TrimRight(o.BaseURL, "/"),
+		UserAgent: o.UserAgent,
+		HTTP:      o.HTTPClient,
+	}
+	if c.BaseURL == "" {
+		c.BaseURL = DefaultBaseURL
+	}
+	if _, err := url.Parse(c.BaseURL); err != nil {
+		return nil, err
+	}
+	if c.HTTP != nil {
+		return c, nil
+	}
+
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	proxy := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+	// no overall http.Client timeout: it would cut off runtime reports
+	// still streaming in. A body that stops arriving is cut off instead
+	c.IdleTimeout = timeout
+	c.HTTP = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           (&net.Dialer{Timeout: connectTimeout}).DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+	return c, nil
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultClient *Client
+)
+
+// Default returns the client used when none is configured: the real ecobee
+// API, with the default timeout and proxies from the environment
+func Default() *Client {
+	defaultOnce.Do(func() {
+		defaultClient, _ = New(Options{}) // nolint: cannot fail without options
+	})
+	return defaultClient
+}
+
+// NewRequest builds a request for path, relative to the base URL
+func (c *Client) NewRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return req, nil
+}
+
+// Do sends req. With an IdleTimeout, reading the response body fails with
+// a timeout once none of it has arrived for that long
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.IdleTimeout <= 0 {
+		return c.HTTP.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	res, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	b := &idleBody{body: res.Body, cancel: cancel, timeout: c.IdleTimeout}
+	b.timer = time.AfterFunc(c.IdleTimeout, b.expire)
+	res.Body = b
+	return res, nil
+}
+
+// a response body whose request is cancelled once reads stall
+type idleBody struct {
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (b *idleBody) expire() {
+	b.mu.Lock()
+	b.expired = true
+	b.mu.Unlock()
+	b.cancel()
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	if err != nil {
+		b.mu.Lock()
+		expired := b.expired
+		b.mu.Unlock()
+		if expired {
+			return n, errIdle
+		}
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+// a stalled response body. A net.Error, so it is retried like other
+// timeouts
+var errIdle error = idleError{}
+
+type idleError struct{}
+
+func (idleError) Error() string   { return "ecobee response body stalled" }
+func (idleError) Timeout() bool   { return true }
+func (idleError) Temporary() bool { return true }
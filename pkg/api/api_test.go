@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/stall":
+			w.Write([]byte("row\n")) // nolint
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		}
+		// a body that takes longer than the timeout to arrive in full
+		w.(http.Flusher).Flush()
+		for i := 0; i < 4; i++ {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("row\n")) // nolint
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	c, err := New(Options{BaseURL: srv.URL, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ctx context.Context, path string) (string, error) {
+		req, err := c.NewRequest(ctx, "GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	if body, err := get(context.Background(), "/"); err != nil || body != "row\nrow\nrow\nrow\n" {
+		t.Errorf("a response streaming past the timeout was cut off: %q, %v", body, err)
+	}
+
+	var ne net.Error
+	if _, err := get(context.Background(), "/slow"); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("expected a timeout waiting for the response to start, got %v", err)
+	}
+
+	// a body that stops arriving is cut off, rather than hanging for good
+	if body, err := get(context.Background(), "/stall"); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("expected a timeout once the body stalled, got %q, %v", body, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 75*time.Millisecond)
+	defer cancel()
+	if _, err := get(ctx, "/"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request's context to bound reading the body, got %v", err)
+	}
+}
@@ -1,18 +1,50 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net"
-	"net/http"
 	"net/url"
+	"sync"
 	"time"
+
+	"github.com/pzl/elastibee/pkg/api"
 )
 
-const eco = "https://api.ecobee.com"
 const pin = "ecobeePin"
-const scope = "smartWrite"
+
+// scopes an app can ask to be authorized for
+const (
+	ScopeRead  = "smartRead"  // read thermostat data only
+	ScopeWrite = "smartWrite" // read and change thermostat settings
+	ScopeEMS   = "ems"        // read and write for EMS (commercial) accounts
+)
+
+// Writes reports whether tokens for scope can change thermostats: anything
+// but smartRead, since ems is smartWrite for EMS accounts. Empty is
+// DefaultScope
+func Writes(scope string) bool {
+	return scope != ScopeRead
+}
+
+// DefaultScope is requested when a Client has none set
+const DefaultScope = ScopeWrite
+
+// DefaultTimeout bounds each authorization request when a Client has no
+// Timeout set. It is shorter than the API client's own timeout, as it
+// always has been: the authorize and token endpoints answer quickly, and a
+// user is waiting on them
+const DefaultTimeout = 30 * time.Second
+
+// ValidScope reports an error for anything ecobee doesn't know as a scope
+func ValidScope(s string) error {
+	switch s {
+	case ScopeRead, ScopeWrite, ScopeEMS:
+		return nil
+	}
+	return fmt.Errorf("unknown scope %q. Use %s, %s or %s", s, ScopeRead, ScopeWrite, ScopeEMS)
+}
 
 type TokenResponse struct {
 	AccessToken string `json:"access_token"`
@@ -34,20 +66,78 @@ type PinResponse struct {
 	Interval int    `json:"interval"`
 }
 
+// Client makes authorization requests through the given API settings
+type Client struct {
+	API     *api.Client
+	Scope   string        // to authorize for; DefaultScope when empty
+	Timeout time.Duration // per request; DefaultTimeout when zero
+}
+
+func NewClient(c *api.Client) *Client {
+	return &Client{API: c}
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultClient *Client
+)
+
+// Default returns the client behind the package-level functions: the
+// default scope and timeout, through api.Default()
+func Default() *Client {
+	defaultOnce.Do(func() {
+		defaultClient = NewClient(api.Default())
+	})
+	return defaultClient
+}
+
+func (c *Client) scope() string {
+	if c.Scope == "" {
+		return DefaultScope
+	}
+	return c.Scope
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
 // creates a new PIN for the user to enter into their ecobee portal
 func MakePin(appKey string) (PinResponse, error) {
+	return Default().MakePin(context.Background(), appKey)
+}
+
+// after successful pin entry, converts the associated pin code into usable tokens
+func MakeToken(appKey string, code string) (TokenResponse, error) {
+	return Default().MakeToken(context.Background(), appKey, code)
+}
+
+func Refresh(appKey string, token string) (TokenResponse, error) {
+	return Default().Refresh(context.Background(), appKey, token)
+}
+
+func (c *Client) MakePin(ctx context.Context, appKey string) (PinResponse, error) {
 	pr := PinResponse{}
-	client := httpClient(30 * time.Second) // generous timeout, since ecobee servers are occasionally... sluggish
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
 
 	params := url.Values{}
 	params.Add("response_type", pin)
 	params.Add("client_id", appKey)
-	params.Add("scope", scope)
+	params.Add("scope", c.scope())
 
-	res, err := client.Get(eco + "/authorize?" + params.Encode())
+	req, err := c.API.NewRequest(ctx, "GET", "/authorize?"+params.Encode(), nil)
 	if err != nil {
 		return pr, err
 	}
+	res, err := c.API.Do(req)
+	if err != nil {
+		return pr, err
+	}
+	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return pr, err
@@ -59,46 +149,38 @@ func MakePin(appKey string) (PinResponse, error) {
 	return pr, nil
 }
 
-// after successful pin entry, converts the associated pin code into usable tokens
-func MakeToken(appKey string, code string) (TokenResponse, error) {
-	tr := TokenResponse{}
-	client := httpClient(30 * time.Second) // generous timeout, since ecobee servers are occasionally... sluggish
-
+func (c *Client) MakeToken(ctx context.Context, appKey string, code string) (TokenResponse, error) {
 	params := url.Values{}
 	params.Add("grant_type", pin)
 	params.Add("client_id", appKey)
 	params.Add("code", code)
-
-	res, err := client.Post(eco+"/token?"+params.Encode(), "application/json", nil)
-	if err != nil {
-		return tr, err
-	}
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return tr, err
-	}
-	if err := json.Unmarshal(body, &tr); err != nil {
-		return tr, err
-	}
-	if tr.Error != "" {
-		return tr, fmt.Errorf("%s: %s", tr.Error, tr.ErrorDesc)
-	}
-	return tr, nil
+	return c.token(ctx, params)
 }
 
-func Refresh(appKey string, token string) (TokenResponse, error) {
-	tr := TokenResponse{}
-	client := httpClient(30 * time.Second) // generous timeout, since ecobee servers are occasionally... sluggish
-
+func (c *Client) Refresh(ctx context.Context, appKey string, token string) (TokenResponse, error) {
 	params := url.Values{}
 	params.Add("grant_type", "refresh_token")
 	params.Add("refresh_token", token)
 	params.Add("client_id", appKey)
+	return c.token(ctx, params)
+}
 
-	res, err := client.Post(eco+"/token?"+params.Encode(), "application/json", nil)
+// posts to the token endpoint with the given grant parameters
+func (c *Client) token(ctx context.Context, params url.Values) (TokenResponse, error) {
+	tr := TokenResponse{}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	req, err := c.API.NewRequest(ctx, "POST", "/token?"+params.Encode(), nil)
+	if err != nil {
+		return tr, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.API.Do(req)
 	if err != nil {
 		return tr, err
 	}
+	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return tr, err
@@ -107,17 +189,7 @@ func Refresh(appKey string, token string) (TokenResponse, error) {
 		return tr, err
 	}
 	if tr.Error != "" {
-		return tr, fmt.Errorf("%s: %s", tr.Error, tr.ErrorDesc)
+		return tr, &Error{Code: tr.Error, Description: tr.ErrorDesc, URI: tr.ErrorURI, HTTPStatus: res.StatusCode}
 	}
 	return tr, nil
 }
-
-func httpClient(timeout time.Duration) *http.Client {
-	return &http.Client{
-		Timeout: timeout,
-		Transport: &http.Transport{
-			Dial:                (&net.Dialer{Timeout: timeout}).Dial,
-			TLSHandshakeTimeout: timeout,
-		},
-	}
-}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// the authorization_code grant, for apps registered with a redirect URI.
+// The user signs in to ecobee in their browser, which is sent back to a
+// listener here with a code to trade for tokens
+
+// AuthorizeURL is the ecobee page to send the user to. ecobee redirects
+// back to redirectURI with state and a code for ExchangeCode
+func (c *Client) AuthorizeURL(appKey string, redirectURI string, state string) string {
+	params := url.Values{}
+	params.Add("response_type", "code")
+	params.Add("client_id", appKey)
+	params.Add("redirect_uri", redirectURI)
+	params.Add("scope", c.scope())
+	params.Add("state", state)
+	return c.API.BaseURL + "/authorize?" + params.Encode()
+}
+
+// ExchangeCode trades an authorization code for tokens. redirectURI must
+// match the one the code was issued for
+func (c *Client) ExchangeCode(ctx context.Context, appKey string, code string, redirectURI string) (TokenResponse, error) {
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("code", code)
+	params.Add("redirect_uri", redirectURI)
+	params.Add("client_id", appKey)
+	return c.token(ctx, params)
+}
+
+// AuthorizeCode runs the whole flow: it listens on addr (e.g.
+// "127.0.0.1:8910") for the redirect, hands the authorize URL to open for
+// showing to the user, and exchanges the code it receives for tokens. The
+// redirect URI, http://<addr>/callback, must be registered for the app
+func (c *Client) AuthorizeCode(ctx context.Context, appKey string, addr string, open func(url string)) (TokenResponse, error) {
+	r, err := ListenRedirect(addr)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer r.Close() // nolint
+
+	open(c.AuthorizeURL(appKey, r.URI, r.State))
+
+	code, err := r.Wait(ctx)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return c.ExchangeCode(ctx, appKey, code, r.URI)
+}
+
+// Redirect is a local HTTP listener receiving the redirect back from ecobee
+type Redirect struct {
+	URI   string // to send as redirect_uri
+	State string // to send as state; the callback must echo it
+
+	srv    *http.Server
+	result chan callback
+}
+
+type callback struct {
+	code string
+	err  error
+}
+
+// ListenRedirect starts listening on addr. A port of 0 picks a free one,
+// though ecobee will only redirect to the exact URI registered
+func ListenRedirect(addr string) (*Redirect, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	r := &Redirect{
+		URI:    "http://" + ln.Addr().String() + "/callback",
+		State:  hex.EncodeToString(state),
+		result: make(chan callback, 1),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", r.handle)
+	r.srv = &http.Server{Handler: mux}
+	go r.srv.Serve(ln) // nolint: returns once closed
+	return r, nil
+}
+
+func (r *Redirect) handle(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	var cb callback
+	switch {
+	case q.Get("state") != r.State:
+		// not ours: a stale tab or a forged request. Keep waiting
+		http.Error(w, "state mismatch", http.StatusBadRequest)
+		return
+	case q.Get("error") != "":
+		cb.err = &Error{Code: q.Get("error"), Description: q.Get("error_description"), URI: q.Get("error_uri")}
+	case q.Get("code") == "":
+		cb.err = fmt.Errorf("redirect carried no authorization code")
+	default:
+		cb.code = q.Get("code")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if cb.err != nil {
+		fmt.Fprintf(w, "<p>Authorization failed: %s</p>", html.EscapeString(cb.err.Error()))
+	} else {
+		fmt.Fprint(w, "<p>elastibee is authorized. You can close this window.</p>")
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	select {
+	case r.result <- cb:
+	default: // already answered
+	}
+}
+
+// Wait blocks until the redirect arrives or ctx is done
+func (r *Redirect) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case cb := <-r.result:
+		return cb.code, cb.err
+	}
+}
+
+func (r *Redirect) Close() error {
+	return r.srv.Close()
+}
@@ -0,0 +1,113 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/auth"
+	"github.com/pzl/elastibee/pkg/eco/ecotest"
+)
+
+// the user's browser: fetches u, following any redirects, and reports the
+// final status
+func visit(t *testing.T, u string) int {
+	t.Helper()
+	res, err := http.Get(u)
+	if err != nil {
+		t.Errorf("GET %s: %v", u, err)
+		return 0
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body) // nolint
+	return res.StatusCode
+}
+
+// the redirect URI and state an authorize URL carries
+func redirectOf(t *testing.T, authorizeURL string) (string, string) {
+	t.Helper()
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("redirect_uri"), u.Query().Get("state")
+}
+
+func TestAuthorizeCode(t *testing.T) {
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	c := auth.NewClient(srv.API())
+	c.Scope = auth.ScopeRead
+
+	tests := []struct {
+		name string
+		open func(t *testing.T, authorizeURL string)
+		err  string // the auth.Error code expected, if any
+	}{
+		{"approved", func(t *testing.T, u string) {
+			if status := visit(t, u); status != http.StatusOK {
+				t.Errorf("callback answered %d", status)
+			}
+		}, ""},
+		{"state mismatch ignored", func(t *testing.T, u string) {
+			redirect, _ := redirectOf(t, u)
+			if status := visit(t, redirect+"?state=forged&code=stolen"); status != http.StatusBadRequest {
+				t.Errorf("forged callback answered %d, expected 400", status)
+			}
+			// still waiting for the real one
+			visit(t, u)
+		}, ""},
+		{"denied", func(t *testing.T, u string) {
+			redirect, state := redirectOf(t, u)
+			visit(t, redirect+"?"+url.Values{"state": {state}, "error": {"access_denied"}, "error_description": {"The user denied access"}}.Encode())
+		}, "access_denied"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			done := make(chan struct{})
+			tk, err := c.AuthorizeCode(ctx, ecotest.AppKey, "127.0.0.1:0", func(u string) {
+				go func() {
+					defer close(done)
+					tc.open(t, u)
+				}()
+			})
+			<-done
+			if tc.err != "" {
+				var ae *auth.Error
+				if !errors.As(err, &ae) || ae.Code != tc.err {
+					t.Fatalf("expected a %s error, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tk.AccessToken == "" || tk.Scope != auth.ScopeRead {
+				t.Errorf("tokens %+v, expected them for %s", tk, auth.ScopeRead)
+			}
+		})
+	}
+}
+
+func TestAuthorizeCodeCancel(t *testing.T) {
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the user never comes back
+	_, err := auth.NewClient(srv.API()).AuthorizeCode(ctx, ecotest.AppKey, "127.0.0.1:0", func(string) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancellation, got %v", err)
+	}
+	if n := srv.Requests("/token"); n != 0 {
+		t.Errorf("%d token requests without a code", n)
+	}
+}
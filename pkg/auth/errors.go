@@ -0,0 +1,32 @@
+package auth
+
+import "errors"
+
+// OAuth error codes ecobee returns from the token endpoint
+const (
+	CodePending      = "authorization_pending" // user hasn't entered the PIN yet
+	CodeExpired      = "authorization_expired" // the PIN expired before being entered
+	CodeSlowDown     = "slow_down"             // polling too quickly
+	CodeInvalidGrant = "invalid_grant"         // code or refresh token is invalid, or was already used
+)
+
+// Error is an error response from the token endpoint
+type Error struct {
+	Code        string
+	Description string
+	URI         string
+	HTTPStatus  int
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// ErrPinExpired is returned when polling outlasts the PIN
+var ErrPinExpired = errors.New("PIN expired before it was authorized")
+
+// reports whether err is a token endpoint error with the given code
+func hasCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
@@ -0,0 +1,13 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// SetSecond shortens the second PollToken waits in, for t
+func SetSecond(t *testing.T, d time.Duration) {
+	old := second
+	second = d
+	t.Cleanup(func() { second = old })
+}
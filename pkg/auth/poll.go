@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// defaults for a PinResponse missing its interval or lifetime, as ecobee
+// hands them out
+const (
+	defaultPinInterval = 30 // seconds
+	defaultPinExpires  = 9  // minutes
+)
+
+// the second PollToken counts its interval, backoff and ticks in. Tests
+// shorten it
+var second = time.Second
+
+// PollToken waits for the user to enter pin in the ecobee portal, then
+// returns the tokens for it. See Client.PollToken
+func PollToken(ctx context.Context, appKey string, pin PinResponse, tick func(remaining time.Duration)) (TokenResponse, error) {
+	return Default().PollToken(ctx, appKey, pin, tick)
+}
+
+// PollToken checks the token endpoint every pin.Interval seconds until the
+// user authorizes the PIN, it expires (after pin.Expires minutes), or ctx
+// is done, with ecobee's usual values for either when missing. When polled
+// too quickly, the interval backs off. tick, if set, is called about once
+// a second with the time left on the PIN
+func (c *Client) PollToken(ctx context.Context, appKey string, pin PinResponse, tick func(remaining time.Duration)) (TokenResponse, error) {
+	if pin.Interval <= 0 {
+		pin.Interval = defaultPinInterval
+	}
+	if pin.Expires <= 0 {
+		pin.Expires = defaultPinExpires
+	}
+	interval := time.Duration(pin.Interval) * second
+	deadline := time.Now().Add(time.Duration(pin.Expires) * 60 * second)
+
+	ticker := time.NewTicker(second)
+	defer ticker.Stop()
+
+	for {
+		next := time.Now().Add(interval)
+		for now := time.Now(); now.Before(next); now = time.Now() {
+			if now.After(deadline) {
+				return TokenResponse{}, ErrPinExpired
+			}
+			if tick != nil {
+				tick(deadline.Sub(now))
+			}
+			select {
+			case <-ctx.Done():
+				return TokenResponse{}, ctx.Err()
+			case <-ticker.C:
+			}
+		}
+
+		tk, err := c.MakeToken(ctx, appKey, pin.Code)
+		switch {
+		case err == nil:
+			return tk, nil
+		case hasCode(err, CodePending):
+		case hasCode(err, CodeSlowDown):
+			interval += 5 * second
+		case hasCode(err, CodeExpired):
+			return tk, ErrPinExpired
+		default:
+			return tk, err
+		}
+	}
+}
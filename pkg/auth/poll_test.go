@@ -0,0 +1,151 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/api"
+	"github.com/pzl/elastibee/pkg/auth"
+	"github.com/pzl/elastibee/pkg/eco/ecotest"
+)
+
+func TestPollToken(t *testing.T) {
+	auth.SetSecond(t, time.Millisecond)
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	c := auth.NewClient(srv.API())
+	ctx := context.Background()
+
+	pin, err := c.MakePin(ctx, ecotest.AppKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// entered once the first poll has come back pending
+	tk, err := c.PollToken(ctx, ecotest.AppKey, pin, func(time.Duration) {
+		if srv.Requests("/token") > 0 {
+			srv.Authorize(pin.Code)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.AccessToken == "" || tk.Refresh == "" {
+		t.Errorf("no tokens: %+v", tk)
+	}
+	if n := srv.Requests("/token"); n != 2 {
+		t.Errorf("%d polls, expected one pending and one authorized", n)
+	}
+}
+
+func TestPollTokenExpired(t *testing.T) {
+	auth.SetSecond(t, time.Millisecond)
+	ctx := context.Background()
+
+	// ecobee reporting the PIN expired. Its lifetime rounds down to 0
+	// minutes, which must not expire it before the first poll
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	srv.PinTTL = time.Millisecond
+	c := auth.NewClient(srv.API())
+	pin, err := c.MakePin(ctx, ecotest.AppKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin.Expires != 0 {
+		t.Fatalf("PIN lasts %d minutes, expected it rounded down to 0", pin.Expires)
+	}
+	if _, err := c.PollToken(ctx, ecotest.AppKey, pin, nil); !errors.Is(err, auth.ErrPinExpired) {
+		t.Errorf("expected ErrPinExpired from ecobee, got %v", err)
+	}
+	if n := srv.Requests("/token"); n != 1 {
+		t.Errorf("%d polls, expected 1", n)
+	}
+
+	// outlasting the PIN's lifetime while ecobee still says pending
+	srv = ecotest.NewServer()
+	defer srv.Close()
+	c = auth.NewClient(srv.API())
+	pin, err = c.MakePin(ctx, ecotest.AppKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin.Expires = 1 // 60 shortened seconds
+	var remaining []time.Duration
+	_, err = c.PollToken(ctx, ecotest.AppKey, pin, func(d time.Duration) { remaining = append(remaining, d) })
+	if !errors.Is(err, auth.ErrPinExpired) {
+		t.Errorf("expected ErrPinExpired once the PIN ran out, got %v", err)
+	}
+	if len(remaining) == 0 || remaining[0] > 60*time.Millisecond || remaining[len(remaining)-1] < 0 {
+		t.Errorf("tick reported %v left", remaining)
+	}
+}
+
+func TestPollTokenSlowDown(t *testing.T) {
+	auth.SetSecond(t, 10*time.Millisecond)
+
+	// asks to slow down twice, then hands out tokens
+	var (
+		mu    sync.Mutex
+		polls []time.Time
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls = append(polls, time.Now())
+		n := len(polls)
+		mu.Unlock()
+		if n < 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(auth.TokenResponse{Error: auth.CodeSlowDown}) // nolint
+			return
+		}
+		json.NewEncoder(w).Encode(auth.TokenResponse{AccessToken: "access", Refresh: "refresh"}) // nolint
+	}))
+	defer srv.Close()
+	a, err := api.New(api.Options{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pin := auth.PinResponse{Code: "code", Expires: 9, Interval: 1}
+	if _, err := auth.NewClient(a).PollToken(context.Background(), "key", pin, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(polls) != 3 {
+		t.Fatalf("%d polls, expected 3", len(polls))
+	}
+	// 1 second, then 6, then 11
+	for i, min := range []time.Duration{60 * time.Millisecond, 110 * time.Millisecond} {
+		if gap := polls[i+1].Sub(polls[i]); gap < min {
+			t.Errorf("poll %d came %v after the one before, expected at least %v", i+2, gap, min)
+		}
+	}
+}
+
+func TestPollTokenCancel(t *testing.T) {
+	auth.SetSecond(t, time.Millisecond)
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	c := auth.NewClient(srv.API())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pin, err := c.MakePin(ctx, ecotest.AppKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// given up on once the first poll has come back pending
+	_, err = c.PollToken(ctx, ecotest.AppKey, pin, func(time.Duration) {
+		if srv.Requests("/token") > 0 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancellation, got %v", err)
+	}
+}
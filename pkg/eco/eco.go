@@ -1,26 +1,38 @@
 package eco
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/pzl/elastibee/pkg/api"
 	"github.com/pzl/elastibee/pkg/auth"
 )
 
-const base = "https://api.ecobee.com"
-const filename = "app.json"
-
 type App struct {
 	AppKey       string   `json:"app_key"`
 	AccessToken  string   `json:"access_token"`
 	RefreshToken string   `json:"refresh_token"`
 	Thermostats  []string `json:"thermostats,omitempty"`
+
+	AccessExpires time.Time `json:"access_expires"` // zero when unknown
+	RefreshIssued time.Time `json:"refresh_issued"` // last time ecobee handed out the refresh token
+
+	// what the tokens were authorized for, and what to ask for when
+	// authorizing again. Empty is treated as auth.DefaultScope
+	Scope string `json:"scope,omitempty"`
+
+	// set once ecobee rejects the credentials outright, until re-authorized
+	Invalid *Invalidation `json:"invalid,omitempty"`
+
+	client *api.Client
+	store  TokenStore
 }
 
 type RequestStatus struct {
@@ -91,8 +103,9 @@ func (r ResponseCode) String() string {
 	return fmt.Sprintf("unknown response code: %d", r)
 }
 
-func rawfetch(method string, url string, body io.Reader, token string) ([]byte, error) {
-	req, err := http.NewRequest(method, base+url, body)
+// performs the request, handing back the response with its body unread
+func rawstream(ctx context.Context, c *api.Client, method string, url string, body io.Reader, token string) (*http.Response, error) {
+	req, err := c.NewRequest(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -100,87 +113,165 @@ func rawfetch(method string, url string, body io.Reader, token string) ([]byte,
 	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	c := httpClient(90 * time.Second)
-	res, err := c.Do(req)
-	if err != nil {
+	return c.Do(req)
+}
+
+func (a *App) fetch(ctx context.Context, method string, url string, body []byte) ([]byte, error) {
+	if err := a.checkValid(); err != nil {
 		return nil, err
 	}
-	buf, err := ioutil.ReadAll(res.Body)
-	if err != nil {
+	if method != "GET" && !a.CanWrite() {
+		return nil, fmt.Errorf("%s %s: %w", method, endpoint(url), ErrReadOnly)
+	}
+	if err := a.ensureFresh(ctx); err != nil {
 		return nil, err
 	}
-	return buf, nil
+	for refreshes := 0; ; refreshes++ {
+		res, err := send(ctx, a.API(), method, url, body, a.AccessToken)
+		if err != nil {
+			return nil, err
+		}
 
-}
+		buf, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, badResponse(endpoint(url), res.StatusCode, err)
+		}
 
-func (a *App) fetch(method string, url string, body io.Reader) ([]byte, error) {
-	buf, err := rawfetch(method, url, body, a.AccessToken)
-	if err != nil {
-		return nil, err
-	}
+		var status RequestStatus
+		if err := json.Unmarshal(buf, &status); err != nil {
+			return nil, badResponse(endpoint(url), res.StatusCode, err)
+		}
 
-	var status RequestStatus
-	if err := json.Unmarshal(buf, &status); err != nil {
-		return nil, err
+		if err := statusError(url, res.StatusCode, status); err != nil {
+			if errors.Is(err, ErrTokenExpired) && refreshes < maxRefreshes {
+				if err := a.RefreshContext(ctx); err != nil {
+					return nil, fmt.Errorf("access token expired. Got error when refreshing: %w", err)
+				}
+				continue
+			}
+			return nil, a.rejected(err)
+		}
+
+		return buf, nil
 	}
+}
 
-	if status.Status.Code != StatusSuccess {
-		switch status.Status.Code {
-		case StatusTokenExpired:
-			if err := a.Refresh(); err != nil {
-				return nil, fmt.Errorf("access token expired. Got error when refreshing: %w", err)
-			}
-			return a.fetch(method, url, body)
-		default:
-			return nil, fmt.Errorf("Code %d (%s): %s", status.Status.Code, status.Status.Code, status.Status.Message)
+// converts a decoded response status into an *APIError, or nil on success
+func statusError(url string, httpStatus int, status RequestStatus) error {
+	if status.Status.Code == StatusSuccess {
+		if httpStatus != http.StatusOK {
+			return badResponse(endpoint(url), httpStatus, errors.New(http.StatusText(httpStatus)))
 		}
+		return nil
 	}
+	return &APIError{
+		Code:       status.Status.Code,
+		Message:    status.Status.Message,
+		HTTPStatus: httpStatus,
+		Endpoint:   endpoint(url),
+	}
+}
 
-	return buf, nil
+// strips the query from a request path, leaving e.g. /1/runtimeReport
+func endpoint(url string) string {
+	return strings.SplitN(url, "?", 2)[0]
 }
 
 func (a *App) Refresh() error {
-	tk, err := auth.Refresh(a.AppKey, a.RefreshToken)
+	return a.RefreshContext(context.Background())
+}
+
+// RefreshContext trades the refresh token for new tokens and saves them.
+// Stores that implement Locker stay locked throughout, so concurrent
+// processes don't each spend the same refresh token
+func (a *App) RefreshContext(ctx context.Context) error {
+	store := a.Store()
+	if l, ok := store.(Locker); ok {
+		unlock, err := lockStore(ctx, l)
+		if err != nil {
+			return err
+		}
+		defer unlock() // nolint
+
+		// someone else may have refreshed while we waited on the lock,
+		// rotating out the refresh token we hold. Use theirs instead
+		if cur, err := store.Load(); err == nil && cur.RefreshToken != a.RefreshToken && cur.RefreshToken != "" {
+			a.adopt(cur)
+			if a.AccessExpires.IsZero() || time.Until(a.AccessExpires) > refreshAhead {
+				return nil
+			}
+		}
+	}
+
+	if err := a.checkValid(); err != nil {
+		return err
+	}
+	tk, err := a.Auth().Refresh(ctx, a.AppKey, a.RefreshToken)
 	if err != nil {
+		// the store may already be locked here, so save directly
+		if a.invalidate(err) {
+			if serr := store.Save(a); serr != nil && !errors.Is(serr, ErrReadOnlyStore) {
+				return fmt.Errorf("%w (and marking credentials invalid failed: %v)", err, serr)
+			}
+			return &InvalidError{*a.Invalid}
+		}
 		return err
 	}
-	if tk.AccessToken == "" || tk.Refresh == "" {
-		return errors.New("empty tokens in response")
+	// ecobee has rotated the refresh token already, so the new pair is
+	// kept even when its scope is too broad; that is reported after
+	allowed := a.Scope
+	if err := a.setTokens(tk); err != nil {
+		return err
 	}
-	a.AccessToken = tk.AccessToken
-	a.RefreshToken = tk.Refresh
-	return a.Save()
-}
-
-func (a App) Save() error {
-	data, err := json.Marshal(a)
-	if err != nil {
+	// read-only stores keep working with the new tokens for as long as
+	// this process lives
+	if err := store.Save(a); err != nil && !errors.Is(err, ErrReadOnlyStore) {
 		return err
 	}
-	return ioutil.WriteFile(filename, data, 0600)
+	if tk.Scope == "" {
+		return nil
+	}
+	return checkScope(tk.Scope, allowed)
 }
 
-func Open() (*App, error) {
-	var a App
+// SetAPI points the app at a different API server or HTTP client. Without
+// one, api.Default() is used
+func (a *App) SetAPI(c *api.Client) {
+	a.client = c
+}
 
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
+func (a *App) API() *api.Client {
+	if a.client == nil {
+		return api.Default()
 	}
+	return a.client
+}
 
-	if err := json.Unmarshal(data, &a); err != nil {
-		return nil, err
-	}
+// Auth returns an authorization client using the app's API settings and
+// asking for its scope
+func (a *App) Auth() *auth.Client {
+	return &auth.Client{API: a.API(), Scope: a.Scope}
+}
 
-	return &a, nil
+// CanWrite reports whether the app's scope allows changing thermostats.
+// Write requests fail with ErrReadOnly otherwise
+func (a *App) CanWrite() bool {
+	return a.Scope != auth.ScopeRead
 }
 
-func httpClient(timeout time.Duration) *http.Client {
-	return &http.Client{
-		Timeout: timeout,
-		Transport: &http.Transport{
-			Dial:                (&net.Dialer{Timeout: timeout}).Dial,
-			TLSHandshakeTimeout: timeout,
-		},
+// CheckScope fails with ErrScopeTooBroad when the app's tokens allow
+// changing thermostats and allowed, the scope it is meant to have, doesn't
+func (a *App) CheckScope(allowed string) error {
+	return checkScope(a.Scope, allowed)
+}
+
+func checkScope(granted string, allowed string) error {
+	if allowed == "" || auth.Writes(allowed) || !auth.Writes(granted) {
+		return nil
+	}
+	if granted == "" {
+		granted = auth.DefaultScope
 	}
+	return fmt.Errorf("%w: tokens allow %s, only %s is allowed", ErrScopeTooBroad, granted, allowed)
 }
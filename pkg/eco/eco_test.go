@@ -0,0 +1,212 @@
+package eco_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/pzl/elastibee/pkg/auth"
+	"github.com/pzl/elastibee/pkg/eco"
+	"github.com/pzl/elastibee/pkg/eco/ecotest"
+)
+
+func init() {
+	// the fake needs no protecting
+	eco.SetRateLimit(0, 1)
+}
+
+// authorizes a new app against srv through the PIN flow, saving it to a
+// file in a temporary directory
+func authorize(t *testing.T, srv *ecotest.Server) *eco.App {
+	t.Helper()
+	ctx := context.Background()
+	a := &eco.App{AppKey: ecotest.AppKey}
+	a.SetAPI(srv.API())
+	a.SetStore(eco.FileStore{Path: filepath.Join(t.TempDir(), "app.json")})
+
+	pin, err := a.Auth().MakePin(ctx, a.AppKey)
+	if err != nil {
+		t.Fatalf("MakePin: %v", err)
+	}
+	if pin.Pin == "" || pin.Code == "" {
+		t.Fatalf("MakePin returned no PIN: %+v", pin)
+	}
+
+	var ae *auth.Error
+	if _, err := a.Auth().MakeToken(ctx, a.AppKey, pin.Code); !errors.As(err, &ae) || ae.Code != auth.CodePending {
+		t.Fatalf("MakeToken before the PIN was entered: expected %s, got %v", auth.CodePending, err)
+	}
+
+	srv.Authorize(pin.Code)
+	tk, err := a.Auth().MakeToken(ctx, a.AppKey, pin.Code)
+	if err != nil {
+		t.Fatalf("MakeToken: %v", err)
+	}
+	if err := a.SetTokens(tk); err != nil {
+		t.Fatalf("SetTokens: %v", err)
+	}
+	if err := a.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	return a
+}
+
+func reload(t *testing.T, a *eco.App) *eco.App {
+	t.Helper()
+	cur, err := a.Store().Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cur
+}
+
+// one day of 5 minute intervals, for the thermostat and its two sensors
+const docsPerDay = 288 * 3
+
+func streamDay(a *eco.App) (map[string]int, error) {
+	types := make(map[string]int)
+	err := a.StreamRuntimeData("2020-02-09", "2020-02-09", func(doc map[string]interface{}) error {
+		types[doc["type"].(string)]++
+		return nil
+	})
+	return types, err
+}
+
+func TestPinFlow(t *testing.T) {
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	a := authorize(t, srv)
+
+	ts, err := a.GetThermostats()
+	if err != nil {
+		t.Fatalf("GetThermostats: %v", err)
+	}
+	if len(ts) != 1 || ts[0].ID != "311000000001" {
+		t.Fatalf("unexpected thermostats: %+v", ts)
+	}
+
+	types, err := streamDay(a)
+	if err != nil {
+		t.Fatalf("StreamRuntimeData: %v", err)
+	}
+	if types[eco.DocThermostat] != 288 || types[eco.DocSensor] != 2*288 {
+		t.Errorf("expected %d thermostat and %d sensor documents, got %v", 288, 2*288, types)
+	}
+
+	// the runtime query looked the thermostats up, and kept them
+	if cur := reload(t, a); len(cur.Thermostats) != 1 || cur.Thermostats[0] != "311000000001" {
+		t.Errorf("thermostats were not saved: %v", cur.Thermostats)
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	a := authorize(t, srv)
+	refresh := a.RefreshToken
+
+	srv.ExpireTokens()
+	if _, err := a.GetThermostats(); err != nil {
+		t.Fatalf("GetThermostats with an expired token: %v", err)
+	}
+	if a.RefreshToken == refresh {
+		t.Fatal("expired access token was not refreshed")
+	}
+	if cur := reload(t, a); cur.RefreshToken != a.RefreshToken {
+		t.Errorf("refreshed tokens were not saved: stored %q, holding %q", cur.RefreshToken, a.RefreshToken)
+	}
+
+	// the stream refreshes too, as long as nothing was handed on yet
+	refresh = a.RefreshToken
+	srv.ExpireTokens()
+	types, err := streamDay(a)
+	if err != nil {
+		t.Fatalf("StreamRuntimeData with an expired token: %v", err)
+	}
+	if n := types[eco.DocThermostat] + types[eco.DocSensor]; n != docsPerDay {
+		t.Errorf("expected %d documents after refreshing, got %d", docsPerDay, n)
+	}
+	if a.RefreshToken == refresh {
+		t.Error("stream did not refresh the expired access token")
+	}
+}
+
+func TestDeauthorized(t *testing.T) {
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	a := authorize(t, srv)
+
+	srv.Deauthorize()
+	_, err := a.GetThermostats()
+	if !errors.Is(err, eco.ErrDeauth) || !errors.Is(err, eco.ErrReauthorize) {
+		t.Fatalf("expected a deauthorization error, got %v", err)
+	}
+	if a.Invalid == nil {
+		t.Fatal("credentials were not marked invalid")
+	}
+	if cur := reload(t, a); cur.Invalid == nil {
+		t.Error("invalidation was not saved")
+	}
+
+	// once invalid, requests fail without reaching ecobee
+	sent := srv.Requests("/1/thermostat")
+	if _, err := a.GetThermostats(); !errors.Is(err, eco.ErrReauthorize) {
+		t.Fatalf("expected ErrReauthorize, got %v", err)
+	}
+	if _, err := streamDay(a); !errors.Is(err, eco.ErrReauthorize) {
+		t.Fatalf("expected ErrReauthorize from the stream, got %v", err)
+	}
+	if n := srv.Requests("/1/thermostat") + srv.Requests("/1/runtimeReport"); n != sent {
+		t.Errorf("%d requests sent with invalid credentials", n-sent)
+	}
+}
+
+func TestProcessError(t *testing.T) {
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	a := authorize(t, srv)
+
+	// transient: retried
+	srv.FailNext(eco.StatusProcessErr, 500)
+	if _, err := a.GetThermostats(); err != nil {
+		t.Fatalf("GetThermostats after one process error: %v", err)
+	}
+	if n := srv.Requests("/1/thermostat"); n != 2 {
+		t.Errorf("expected the request to be sent twice, got %d", n)
+	}
+
+	// persistent: given up on once out of attempts
+	for i := 0; i < 10; i++ {
+		srv.FailNext(eco.StatusProcessErr, 500)
+	}
+	_, err := a.GetThermostats()
+	var ae *eco.APIError
+	if !errors.As(err, &ae) || ae.Code != eco.StatusProcessErr {
+		t.Fatalf("expected a process error, got %v", err)
+	}
+	if a.Invalid != nil {
+		t.Error("a process error marked the credentials invalid")
+	}
+}
+
+func TestRefreshScopeTooBroad(t *testing.T) {
+	srv := ecotest.NewServer()
+	defer srv.Close()
+	a := authorize(t, srv) // granted smartWrite
+	refresh := a.RefreshToken
+
+	// configured for reading only since
+	a.Scope = auth.ScopeRead
+	if err := a.Refresh(); !errors.Is(err, eco.ErrScopeTooBroad) {
+		t.Fatalf("expected the refreshed smartWrite tokens to be reported, got %v", err)
+	}
+	// the old refresh token is spent, so the new one must be kept
+	cur := reload(t, a)
+	if cur.RefreshToken == refresh || cur.RefreshToken != a.RefreshToken {
+		t.Errorf("rotated refresh token not saved: stored %q, was %q", cur.RefreshToken, refresh)
+	}
+	if cur.Scope != auth.ScopeWrite {
+		t.Errorf("saved scope %q, expected the %s granted", cur.Scope, auth.ScopeWrite)
+	}
+}
@@ -0,0 +1,502 @@
+// Package ecotest provides an in-process fake of the ecobee API endpoints
+// elastibee uses, for exercising the pin, token and archive flows offline.
+//
+// Runtime reports are synthesized deterministically from the requested
+// dates, so the same request always returns the same rows.
+package ecotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/api"
+	"github.com/pzl/elastibee/pkg/eco"
+)
+
+const AppKey = "ecotest-app-key"
+
+type Server struct {
+	*httptest.Server
+
+	// access token lifetime handed out by /token
+	TokenTTL time.Duration
+
+	// PIN lifetime, and polling interval asked of clients, in seconds
+	PinTTL      time.Duration
+	PinInterval int
+
+	// registered thermostats, and the remote sensors each reports
+	Thermostats []eco.Thermostat
+	Sensors     map[string][]Sensor
+
+	mu       sync.Mutex
+	pins     map[string]*pin      // by code
+	codes    map[string]authCode  // by authorization code
+	access   map[string]time.Time // access token -> expiry
+	refresh  map[string]string    // valid refresh tokens -> scope
+	failures []failure
+	deauth   bool
+	counter  int
+	requests map[string]int
+}
+
+type Sensor struct {
+	ID    string `json:"sensorId"`
+	Name  string `json:"sensorName"`
+	Type  string `json:"sensorType"`
+	Usage string `json:"sensorUsage"`
+}
+
+type pin struct {
+	authorized bool
+	expires    time.Time
+	scope      string
+}
+
+type authCode struct {
+	redirect string
+	scope    string
+}
+
+type failure struct {
+	code       eco.ResponseCode
+	httpStatus int
+}
+
+// NewServer starts a fake with one thermostat carrying a temperature and an
+// occupancy sensor. Close it when done
+func NewServer() *Server {
+	s := &Server{
+		TokenTTL:    time.Hour,
+		PinTTL:      9 * time.Minute,
+		PinInterval: 30,
+		Thermostats: []eco.Thermostat{{
+			ID:         "311000000001",
+			Name:       "Main Floor",
+			Revision:   "200209120000",
+			Registered: true,
+			ModelNo:    "nikeSmart",
+			Brand:      "ecobee",
+		}},
+		Sensors: map[string][]Sensor{
+			"311000000001": {
+				{ID: "rs:100:1", Name: "Bedroom", Type: "temperature", Usage: "dischargeAir"},
+				{ID: "rs:100:2", Name: "Bedroom", Type: "occupancy"},
+			},
+		},
+		pins:     make(map[string]*pin),
+		codes:    make(map[string]authCode),
+		access:   make(map[string]time.Time),
+		refresh:  make(map[string]string),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/1/thermostat", s.api(s.thermostat))
+	mux.HandleFunc("/1/runtimeReport", s.api(s.runtimeReport))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// API returns settings pointing the auth and eco packages at the fake
+func (s *Server) API() *api.Client {
+	c, _ := api.New(api.Options{BaseURL: s.URL, HTTPClient: s.Client()}) // nolint: base URL is always valid
+	return c
+}
+
+// Authorize simulates the user entering the PIN for code in the ecobee portal
+func (s *Server) Authorize(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pins[code]; ok {
+		p.authorized = true
+	}
+}
+
+// Tokens issues a fresh smartWrite access/refresh pair without going
+// through the PIN flow, for seeding an already-authorized App
+func (s *Server) Tokens() (access string, refresh string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issue("smartWrite")
+}
+
+// ExpireTokens makes every access token issued so far report StatusTokenExpired
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t := range s.access {
+		s.access[t] = time.Time{}
+	}
+}
+
+// Deauthorize simulates the user removing the app from their account. All
+// tokens stop working with StatusDeauth until the PIN flow is repeated
+func (s *Server) Deauthorize() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deauth = true
+	s.access = make(map[string]time.Time)
+	s.refresh = make(map[string]string)
+}
+
+// FailNext queues an error response for the next API (not auth) request
+func (s *Server) FailNext(code eco.ResponseCode, httpStatus int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{code: code, httpStatus: httpStatus})
+}
+
+// Requests reports how many requests each path has received
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// caller holds s.mu
+func (s *Server) issue(scope string) (string, string) {
+	s.counter++
+	access := fmt.Sprintf("access-%d", s.counter)
+	refresh := fmt.Sprintf("refresh-%d", s.counter)
+	s.access[access] = time.Now().Add(s.TokenTTL)
+	s.refresh[refresh] = scope
+	s.deauth = false
+	return access, refresh
+}
+
+func (s *Server) count(r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	s.mu.Unlock()
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	s.count(r)
+	q := r.URL.Query()
+	if q.Get("client_id") != AppKey {
+		oauthError(w, http.StatusBadRequest, "invalid_client", "unknown application key")
+		return
+	}
+	if q.Get("response_type") == "code" {
+		s.authorizeCode(w, r)
+		return
+	}
+	if q.Get("response_type") != "ecobeePin" {
+		oauthError(w, http.StatusBadRequest, "unsupported_response_type", "unsupported response_type")
+		return
+	}
+
+	s.mu.Lock()
+	s.counter++
+	n := s.counter
+	code := fmt.Sprintf("pincode-%d", n)
+	s.pins[code] = &pin{expires: time.Now().Add(s.PinTTL), scope: q.Get("scope")}
+	ttl, interval := s.PinTTL, s.PinInterval
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ecobeePin":  fmt.Sprintf("%04X", n),
+		"code":       code,
+		"scope":      q.Get("scope"),
+		"expires_in": int(ttl / time.Minute), // minutes, unlike tokens
+		"interval":   interval,
+	})
+}
+
+// the user approving the app straight away: redirect back with a code
+func (s *Server) authorizeCode(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "invalid redirect_uri")
+		return
+	}
+
+	s.mu.Lock()
+	s.counter++
+	code := fmt.Sprintf("authcode-%d", s.counter)
+	s.codes[code] = authCode{redirect: redirect.String(), scope: q.Get("scope")}
+	s.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	s.count(r)
+	if r.Method != "POST" {
+		oauthError(w, http.StatusMethodNotAllowed, "invalid_request", "POST required")
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("client_id") != AppKey {
+		oauthError(w, http.StatusBadRequest, "invalid_client", "unknown application key")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var scope string
+	switch q.Get("grant_type") {
+	case "ecobeePin":
+		p, ok := s.pins[q.Get("code")]
+		if !ok {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "The authorization grant, token or credentials are invalid.")
+			return
+		}
+		if time.Now().After(p.expires) {
+			delete(s.pins, q.Get("code"))
+			oauthError(w, http.StatusUnauthorized, "authorization_expired", "The authorization has expired waiting for user to authorize.")
+			return
+		}
+		if !p.authorized {
+			oauthError(w, http.StatusUnauthorized, "authorization_pending", "Waiting for user to authorize application.")
+			return
+		}
+		delete(s.pins, q.Get("code"))
+		scope = p.scope
+	case "authorization_code":
+		c, ok := s.codes[q.Get("code")]
+		if !ok || c.redirect != q.Get("redirect_uri") {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "The authorization grant, token or credentials are invalid.")
+			return
+		}
+		delete(s.codes, q.Get("code"))
+		scope = c.scope
+	case "refresh_token":
+		var ok bool
+		if scope, ok = s.refresh[q.Get("refresh_token")]; !ok {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "The authorization grant, token or credentials are invalid.")
+			return
+		}
+		delete(s.refresh, q.Get("refresh_token")) // refresh tokens rotate
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "unsupported grant_type")
+		return
+	}
+
+	access, refresh := s.issue(scope)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.TokenTTL / time.Second),
+		"refresh_token": refresh,
+		"scope":         scope,
+	})
+}
+
+// wraps an API handler with bearer token checks and queued failures
+func (s *Server) api(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.count(r)
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		s.mu.Lock()
+		expiry, known := s.access[token]
+		deauth := s.deauth
+		var fail *failure
+		if len(s.failures) > 0 {
+			fail = &s.failures[0]
+			s.failures = s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		switch {
+		case fail != nil:
+			status(w, fail.httpStatus, fail.code)
+		case deauth:
+			status(w, http.StatusInternalServerError, eco.StatusDeauth)
+		case !known:
+			status(w, http.StatusInternalServerError, eco.StatusAuthFail)
+		case time.Now().After(expiry):
+			status(w, http.StatusInternalServerError, eco.StatusTokenExpired)
+		default:
+			h(w, r)
+		}
+	}
+}
+
+func (s *Server) thermostat(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"page":           map[string]int{"page": 1, "totalPages": 1, "pageSize": len(s.Thermostats), "total": len(s.Thermostats)},
+		"thermostatList": s.Thermostats,
+		"status":         map[string]interface{}{"code": 0, "message": ""},
+	})
+}
+
+func (s *Server) runtimeReport(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		StartDate      string `json:"startDate"`
+		EndDate        string `json:"endDate"`
+		Columns        string `json:"columns"`
+		IncludeSensors bool   `json:"includeSensors"`
+		Selection      struct {
+			Type  string `json:"selectionType"`
+			Match string `json:"selectionMatch"`
+		} `json:"selection"`
+	}
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("body")), &req); err != nil {
+		status(w, http.StatusInternalServerError, eco.StatusInvalidReqFmt)
+		return
+	}
+	start, err1 := time.Parse("2006-01-02", req.StartDate)
+	end, err2 := time.Parse("2006-01-02", req.EndDate)
+	if err1 != nil || err2 != nil || end.Before(start) {
+		status(w, http.StatusInternalServerError, eco.StatusValidationErr)
+		return
+	}
+	ids := strings.Split(req.Selection.Match, ",")
+	if len(ids) > 25 {
+		status(w, http.StatusInternalServerError, eco.StatusTooManyTherm)
+		return
+	}
+
+	cols := strings.Split(req.Columns, ",")
+	var intervals []time.Time
+	for t := start; !t.After(end.Add(23*time.Hour + 55*time.Minute)); t = t.Add(5 * time.Minute) {
+		intervals = append(intervals, t)
+	}
+
+	type report struct {
+		ID       string   `json:"thermostatIdentifier"`
+		RowCount int      `json:"rowCount"`
+		Rows     []string `json:"rowList"`
+	}
+	type sensorReport struct {
+		ID      string   `json:"thermostatIdentifier"`
+		Sensors []Sensor `json:"sensors"`
+		Columns []string `json:"columns"`
+		Data    []string `json:"data"`
+	}
+	reports := []report{}
+	sensors := []sensorReport{}
+	for _, id := range ids {
+		rep := report{ID: id, Rows: make([]string, 0, len(intervals))}
+		for _, t := range intervals {
+			row := []string{t.Format("2006-01-02"), t.Format("15:04:05")}
+			for _, c := range cols {
+				row = append(row, column(c, t))
+			}
+			rep.Rows = append(rep.Rows, strings.Join(row, ","))
+		}
+		rep.RowCount = len(rep.Rows)
+		reports = append(reports, rep)
+
+		if !req.IncludeSensors {
+			continue
+		}
+		sr := sensorReport{ID: id, Sensors: s.Sensors[id], Columns: []string{"date", "time"}}
+		for _, ss := range sr.Sensors {
+			sr.Columns = append(sr.Columns, ss.ID)
+		}
+		for _, t := range intervals {
+			row := []string{t.Format("2006-01-02"), t.Format("15:04:05")}
+			for _, ss := range sr.Sensors {
+				row = append(row, column(ss.Type, t))
+			}
+			sr.Data = append(sr.Data, strings.Join(row, ","))
+		}
+		sensors = append(sensors, sr)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"startDate":     req.StartDate,
+		"startInterval": 0,
+		"endDate":       req.EndDate,
+		"endInterval":   287,
+		"columns":       req.Columns,
+		"reportList":    reports,
+		"sensorList":    sensors,
+		"status":        map[string]interface{}{"code": 0, "message": ""},
+	})
+}
+
+// synthesizes a deterministic value for a runtime or sensor column at t,
+// following a daily cycle
+func column(name string, t time.Time) string {
+	day := float64(t.Hour()*60+t.Minute()) / (24 * 60)
+	wave := math.Sin(2 * math.Pi * day) // -1 overnight .. 1 mid-afternoon
+	switch strings.ToLower(name) {
+	case "auxheat1", "auxheat2", "auxheat3", "compcool1", "compcool2", "dehumidifier",
+		"economizer", "humidifier", "ventilator":
+		return "0"
+	case "compheat1", "compheat2", "fan":
+		// heating runs harder when it's colder out
+		return strconv.Itoa(int(150 - 150*wave))
+	case "outdoortemp":
+		return strconv.FormatFloat(40+15*wave, 'f', 1, 64)
+	case "outdoorhumidity":
+		return strconv.Itoa(int(60 - 20*wave))
+	case "zoneavetemp", "temperature":
+		return strconv.FormatFloat(70+wave, 'f', 1, 64)
+	case "zoneheattemp":
+		return "70.0"
+	case "zonecooltemp":
+		return "76.0"
+	case "zonehumidity", "humidity":
+		return strconv.Itoa(int(40 - 5*wave))
+	case "zonehumidityhigh":
+		return "60"
+	case "zonehumiditylow":
+		return "30"
+	case "dmoffset":
+		return "0.0"
+	case "hvacmode", "zonehvacmode":
+		return "heat"
+	case "zoneclimate":
+		if t.Hour() >= 8 && t.Hour() < 17 {
+			return "Away"
+		}
+		return "Home"
+	case "zonecalendarevent":
+		return ""
+	case "zoneoccupancy", "occupancy":
+		if t.Hour() >= 8 && t.Hour() < 17 {
+			return "0"
+		}
+		return "1"
+	case "sky":
+		return strconv.Itoa(1 + t.YearDay()%8)
+	case "wind":
+		return strconv.Itoa(int(10 + 5*wave))
+	}
+	return ""
+}
+
+func status(w http.ResponseWriter, httpStatus int, code eco.ResponseCode) {
+	writeJSON(w, httpStatus, map[string]interface{}{
+		"status": map[string]interface{}{
+			"code":    code,
+			"message": code.String(),
+		},
+	})
+}
+
+func oauthError(w http.ResponseWriter, httpStatus int, code string, desc string) {
+	writeJSON(w, httpStatus, map[string]string{
+		"error":             code,
+		"error_description": desc,
+		"error_uri":         "https://tools.ietf.org/html/rfc6749#section-5.2",
+	})
+}
+
+func writeJSON(w http.ResponseWriter, httpStatus int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(v) // nolint
+}
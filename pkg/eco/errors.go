@@ -0,0 +1,78 @@
+package eco
+
+import (
+	"errors"
+	"fmt"
+)
+
+// sentinel errors for the authorization-related response codes. Match them
+// with errors.Is against anything returned from App
+var (
+	ErrAuthFail     = errors.New("invalid ecobee credentials")
+	ErrNotAuth      = errors.New("not authorized for requested ecobee resource")
+	ErrTokenExpired = errors.New("ecobee access token expired")
+	ErrDeauth       = errors.New("ecobee authorization revoked by user")
+
+	// matches ErrAuthFail and ErrDeauth, which both need the app to be
+	// authorized again, and is returned without contacting ecobee once
+	// the credentials have been marked invalid
+	ErrReauthorize = errors.New("ecobee authorization is no longer valid")
+
+	// the response was not an ecobee status payload at all (HTML error
+	// pages, truncated bodies, proxies, ...)
+	ErrBadResponse = errors.New("unexpected response from ecobee")
+
+	// a write was attempted with tokens only authorized for reading. It
+	// never reaches ecobee
+	ErrReadOnly = errors.New("ecobee authorization is read-only (smartRead)")
+
+	// the tokens were authorized for more than the app is meant to have,
+	// such as smartWrite when only smartRead was asked for
+	ErrScopeTooBroad = errors.New("ecobee authorization is broader than the configured scope")
+)
+
+// APIError is returned for any response from ecobee that was not a success,
+// whether reported with a status code or only at the HTTP level
+type APIError struct {
+	Code       ResponseCode
+	Message    string
+	HTTPStatus int
+	Endpoint   string
+	Err        error // set when the body could not be read as a status
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: HTTP %d: %v", e.Endpoint, e.HTTPStatus, e.Err)
+	}
+	return fmt.Sprintf("%s: Code %d (%s): %s", e.Endpoint, e.Code, e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error { return e.Err }
+
+func (e *APIError) Is(target error) bool {
+	if e.Err != nil {
+		return false
+	}
+	switch target {
+	case ErrAuthFail:
+		return e.Code == StatusAuthFail
+	case ErrNotAuth:
+		return e.Code == StatusNotAuth
+	case ErrTokenExpired:
+		return e.Code == StatusTokenExpired
+	case ErrDeauth:
+		return e.Code == StatusDeauth
+	case ErrReauthorize:
+		return e.Code == StatusAuthFail || e.Code == StatusDeauth
+	}
+	return false
+}
+
+func badResponse(endpoint string, httpStatus int, err error) *APIError {
+	return &APIError{
+		HTTPStatus: httpStatus,
+		Endpoint:   endpoint,
+		Err:        fmt.Errorf("%w: %v", ErrBadResponse, err),
+	}
+}
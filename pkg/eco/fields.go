@@ -0,0 +1,107 @@
+package eco
+
+import (
+	"sort"
+	"strings"
+)
+
+// kinds of value a document field holds
+const (
+	KindString    = "string"
+	KindInteger   = "integer"
+	KindFloat     = "float"
+	KindBoolean   = "boolean"
+	KindTimestamp = "timestamp" // 2006-01-02T15:04:05, thermostat local time
+	KindDate      = "date"      // 2006-01-02
+	KindTime      = "time"      // 15:04:05
+)
+
+// the reportList columns requested from ecobee, named as they come back
+var reportColumns = []string{
+	"auxHeat1", "auxHeat2", "auxHeat3", "compCool1", "compCool2",
+	"compHeat1", "compHeat2", "dehumidifier", "dmOffset", "economizer",
+	"fan", "humidifier", "hvacMode", "outdoorHumidity", "outdoorTemp", "sky",
+	"ventilator", "wind", "zoneAveTemp", "zoneCalendarEvent", "zoneClimate",
+	"zoneCoolTemp", "zoneHeatTemp", "zoneHumidity", "zoneHumidityHigh",
+	"zoneHumidityLow", "zoneHvacMode", "zoneOccupancy",
+}
+
+// kinds of the reportList columns, by lowercased name. Others are strings
+var columnKinds = map[string]string{
+	"auxheat1":         KindInteger,
+	"auxheat2":         KindInteger,
+	"auxheat3":         KindInteger,
+	"compcool1":        KindInteger,
+	"compcool2":        KindInteger,
+	"compheat1":        KindInteger,
+	"compheat2":        KindInteger,
+	"dehumidifier":     KindInteger,
+	"economizer":       KindInteger,
+	"fan":              KindInteger,
+	"humidifier":       KindInteger,
+	"outdoorhumidity":  KindInteger,
+	"sky":              KindInteger,
+	"ventilator":       KindInteger,
+	"wind":             KindInteger,
+	"zonehumidity":     KindInteger,
+	"zonehumidityhigh": KindInteger,
+	"zonehumiditylow":  KindInteger,
+	"zone":             KindInteger,
+	"dmoffset":         KindFloat,
+	"outdoortemp":      KindFloat,
+	"zoneavetemp":      KindFloat,
+	"zonecooltemp":     KindFloat,
+	"zoneheattemp":     KindFloat,
+	"zoneoccupancy":    KindBoolean,
+}
+
+// kinds of sensor readings, by sensor type. A reading is stored in a field
+// named after its type; unknown types are strings
+// https://www.ecobee.com/home/developer/api/documentation/v1/objects/RuntimeSensorMetadata.shtml
+var sensorKinds = map[string]string{
+	"occupancy":              KindBoolean,
+	"dryContact":             KindBoolean,
+	"temperature":            KindFloat,
+	"co2":                    KindInteger,
+	"ctclamp":                KindInteger,
+	"humidity":               KindInteger,
+	"plug":                   KindInteger,
+	"pulsedElectricityMeter": KindInteger,
+}
+
+// Field is a field runtime documents can carry
+type Field struct {
+	Name     string // nested fields are dotted, like sensor.id
+	Kind     string
+	DocTypes []string // the document types that have it
+}
+
+// Fields lists every field the runtime report transformation can emit,
+// sorted by name. Sensors of types not known here add string fields of
+// their own
+func Fields() []Field {
+	both := []string{DocThermostat, DocSensor}
+	fields := []Field{
+		{Name: "@timestamp", Kind: KindTimestamp, DocTypes: both},
+		{Name: "date", Kind: KindDate, DocTypes: both},
+		{Name: "time", Kind: KindTime, DocTypes: both},
+		{Name: "type", Kind: KindString, DocTypes: both},
+		{Name: "thermostat", Kind: KindString, DocTypes: both},
+		{Name: "sensor.id", Kind: KindString, DocTypes: []string{DocSensor}},
+		{Name: "sensor.name", Kind: KindString, DocTypes: []string{DocSensor}},
+		{Name: "sensor.type", Kind: KindString, DocTypes: []string{DocSensor}},
+		{Name: "sensor.usage", Kind: KindString, DocTypes: []string{DocSensor}},
+	}
+	for _, c := range reportColumns {
+		kind, ok := columnKinds[strings.ToLower(c)]
+		if !ok {
+			kind = KindString
+		}
+		fields = append(fields, Field{Name: c, Kind: kind, DocTypes: []string{DocThermostat}})
+	}
+	for typ, kind := range sensorKinds {
+		fields = append(fields, Field{Name: typ, Kind: kind, DocTypes: []string{DocSensor}})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
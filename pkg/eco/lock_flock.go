@@ -0,0 +1,54 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package eco
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// an advisory lock held on a file for the life of the process, or until
+// unlocked
+type fileLock struct {
+	f *os.File
+}
+
+// waits for an exclusive lock on path, creating it if needed, until ctx is
+// done. The lock is polled for rather than blocked on, so a process stuck
+// holding it can't hang the caller
+func lockFile(ctx context.Context, path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &fileLock{f: f}, nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, err
+		}
+		if err := sleep(ctx, lockPoll); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("waiting for lock %s: %w", path, err)
+		}
+	}
+}
+
+// how often a held lock is checked on
+const lockPoll = 50 * time.Millisecond
+
+func (l *fileLock) unlock() error {
+	defer l.f.Close()
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
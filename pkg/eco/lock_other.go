@@ -0,0 +1,51 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package eco
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// without flock, the lock is the existence of the lock file itself. One
+// left behind by a crashed process is taken over once it is a minute old
+const staleLock = time.Minute
+
+// how often a held lock is checked on
+const lockPoll = 50 * time.Millisecond
+
+type fileLock struct {
+	path string
+}
+
+// waits for an exclusive lock on path until ctx is done
+func lockFile(ctx context.Context, path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return &fileLock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(path) // nolint
+			continue
+		}
+		if err := sleep(ctx, lockPoll); err != nil {
+			return nil, fmt.Errorf("waiting for lock %s: %w", path, err)
+		}
+	}
+}
+
+func (l *fileLock) unlock() error {
+	return os.Remove(l.path)
+}
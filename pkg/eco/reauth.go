@@ -0,0 +1,63 @@
+package eco
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/auth"
+)
+
+// Invalidation records why and when ecobee stopped accepting the app's
+// credentials
+type Invalidation struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// InvalidError is returned for requests made once the credentials are
+// marked invalid. It matches ErrReauthorize
+type InvalidError struct {
+	Invalidation
+}
+
+func (e *InvalidError) Error() string {
+	return fmt.Sprintf("%v since %s: %s", ErrReauthorize, e.At.Format(time.RFC3339), e.Reason)
+}
+
+func (e *InvalidError) Is(target error) bool {
+	return target == ErrReauthorize
+}
+
+// fails fast once the credentials are known to be bad, rather than sending
+// requests ecobee will reject
+func (a *App) checkValid() error {
+	if a.Invalid == nil {
+		return nil
+	}
+	return &InvalidError{*a.Invalid}
+}
+
+// marks the credentials invalid and saves that, when err shows ecobee
+// rejected them: a deauthorized app, or credentials it doesn't recognize.
+// err is returned either way
+func (a *App) rejected(err error) error {
+	if !a.invalidate(err) {
+		return err
+	}
+	if serr := a.Save(); serr != nil && !errors.Is(serr, ErrReadOnlyStore) {
+		return fmt.Errorf("%w (and marking credentials invalid failed: %v)", err, serr)
+	}
+	return err
+}
+
+// records the invalidation on the app without saving, reporting whether err
+// was one. A refresh token ecobee won't accept counts too
+func (a *App) invalidate(err error) bool {
+	var ae *auth.Error
+	if !errors.Is(err, ErrReauthorize) && !(errors.As(err, &ae) && ae.Code == auth.CodeInvalidGrant) {
+		return false
+	}
+	a.Invalid = &Invalidation{Reason: err.Error(), At: time.Now()}
+	return true
+}
@@ -1,6 +1,7 @@
 package eco
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -10,6 +11,15 @@ import (
 
 // https://www.ecobee.com/home/developer/api/documentation/v1/operations/get-runtime-report.shtml
 
+// the "type" of each document produced from a runtime report
+const (
+	DocThermostat = "thermostat" // a reportList row
+	DocSensor     = "sensor"     // one sensor's reading from a sensorList row
+)
+
+// DocTypes lists every document type, e.g. for laying out indices
+var DocTypes = []string{DocThermostat, DocSensor}
+
 type sensor struct {
 	ID    string `json:"sensorId"`
 	Name  string `json:"sensorName"`
@@ -43,30 +53,46 @@ type RuntimeData struct {
 }
 
 func (a *App) GetRuntimeData(start string, end string) (RuntimeData, error) {
+	return a.GetRuntimeDataContext(context.Background(), start, end)
+}
+
+func (a *App) GetRuntimeDataContext(ctx context.Context, start string, end string) (RuntimeData, error) {
+	query, err := a.runtimeQuery(ctx, start, end)
+	if err != nil {
+		return RuntimeData{}, err
+	}
+
+	body, err := a.fetch(ctx, "GET", "/1/runtimeReport?"+query, nil)
+	if err != nil {
+		return RuntimeData{}, err
+	}
+	rd, err := parseRuntime(body)
+	if pe, ok := err.(*ParseError); ok && pe.Start == "" {
+		pe.Start, pe.End = start, end
+	}
+	return rd, err
 
+}
+
+// builds the encoded runtimeReport query, looking up the registered
+// thermostats first if none are saved
+func (a *App) runtimeQuery(ctx context.Context, start string, end string) (string, error) {
 	if len(a.Thermostats) == 0 {
-		ts, err := a.GetThermostats()
+		ts, err := a.GetThermostatsContext(ctx)
 		if err != nil {
-			return RuntimeData{}, fmt.Errorf("no saved thermostat IDs. Got error when fetching registered thermostats: %w", err)
+			return "", fmt.Errorf("no saved thermostat IDs. Got error when fetching registered thermostats: %w", err)
 		}
 		a.Thermostats = make([]string, len(ts))
 		for i := range ts {
 			a.Thermostats[i] = ts[i].ID
 		}
-		a.Save() // nolint
+		a.SaveContext(ctx) // nolint
 	}
 
 	req, err := json.Marshal(map[string]interface{}{
-		"startDate": start,
-		"endDate":   end,
-		"columns": strings.Join([]string{
-			"auxHeat1", "auxHeat2", "auxHeat3", "compCool1", "compCool2",
-			"compHeat1", "compHeat2", "dehumidifier", "dmOffset", "economizer",
-			"fan", "humidifier", "hvacMode", "outdoorHumidity", "outdoorTemp", "sky",
-			"ventilator", "wind", "zoneAveTemp", "zoneCalendarEvent", "zoneClimate",
-			"zoneCoolTemp", "zoneHeatTemp", "zoneHumidity", "zoneHumidityHigh",
-			"zoneHumidityLow", "zoneHvacMode", "zoneOccupancy",
-		}, ","),
+		"startDate":      start,
+		"endDate":        end,
+		"columns":        strings.Join(reportColumns, ","),
 		"includeSensors": true,
 		"selection": map[string]string{
 			"selectionType":  "thermostats",
@@ -74,138 +100,197 @@ func (a *App) GetRuntimeData(start string, end string) (RuntimeData, error) {
 		},
 	})
 	if err != nil {
-		return RuntimeData{}, err
+		return "", err
 	}
 
 	params := url.Values{}
 	params.Add("format", "json")
 	params.Add("body", string(req))
+	return params.Encode(), nil
+}
 
-	body, err := a.fetch("GET", "/1/runtimeReport?"+params.Encode(), nil)
-	if err != nil {
-		return RuntimeData{}, err
-	}
-	return parseRuntime(body)
+// ParseError describes a runtime report that could not be transformed,
+// identifying the report window, thermostat and row where it went wrong
+type ParseError struct {
+	Start      string
+	End        string
+	Thermostat string
+	Row        int
+	Err        error
+}
 
+func (e *ParseError) Error() string {
+	msg := "runtime report"
+	if e.Start != "" || e.End != "" {
+		msg += fmt.Sprintf(" %s -> %s", e.Start, e.End)
+	}
+	if e.Thermostat != "" {
+		msg += ", thermostat " + e.Thermostat
+	}
+	if e.Row > 0 {
+		msg += fmt.Sprintf(", row %d", e.Row)
+	}
+	return msg + ": " + e.Err.Error()
 }
 
+func (e *ParseError) Unwrap() error { return e.Err }
+
 func parseRuntime(d []byte) (RuntimeData, error) {
 	var res ecoRuntimeResponse
 	if err := json.Unmarshal(d, &res); err != nil {
-		return RuntimeData{}, err
+		return RuntimeData{}, &ParseError{Err: err}
+	}
+
+	rows, sensorRows := 0, 0
+	for _, rl := range res.ReportList {
+		rows += len(rl.Rows)
+	}
+	for _, sl := range res.SensorList {
+		sensorRows += len(sl.Data)
 	}
 
 	rd := RuntimeData{
-		Data:       make([]map[string]interface{}, 0, len(res.ReportList[0].Rows)*len(res.ReportList)),
-		SensorData: make([]map[string]interface{}, 0, len(res.SensorList[0].Data)*len(res.SensorList)),
+		Data:       make([]map[string]interface{}, 0, rows),
+		SensorData: make([]map[string]interface{}, 0, sensorRows),
 	}
 
 	cols := strings.Split(res.Columns, ",")
 	for _, rl := range res.ReportList {
-		for _, r := range rl.Rows {
-			fields := strings.Split(r, ",")
-			data := map[string]interface{}{
-				"date":       fields[0],
-				"time":       fields[1],
-				"@timestamp": fields[0] + "T" + fields[1],
-				"type":       "thermostat",
-			}
-			fields = fields[2:]
-			for j, c := range cols {
-				switch strings.ToLower(c) {
-				case "auxheat1", "auxheat2", "auxheat3", "compcool1", "compcool2", "compheat1", "compheat2", "dehumidifier",
-					"economizer", "fan", "humidifier", "outdoorhumidity", "ventilator", "wind", "zonehumidity", "zonehumidityhigh",
-					"zonehumiditylow", "zone":
-					if num, err := strconv.Atoi(fields[j]); err == nil {
-						data[c] = num
-					} else { // failed to convert
-						data[c] = fields[j]
-					}
-				case "dmoffset", "outdoortemp", "zoneavetemp", "zonecooltemp", "zoneheattemp":
-					if num, err := strconv.ParseFloat(fields[j], 64); err == nil {
-						data[c] = num
-					} else {
-						data[c] = fields[j]
-					}
-				case "zoneoccupancy":
-					if fields[j] == "0" {
-						data[c] = false
-					} else {
-						data[c] = true
-					}
-				default:
-					data[c] = fields[j]
-				}
+		for i, r := range rl.Rows {
+			data, err := parseReportRow(rl.ID, cols, r)
+			if err != nil {
+				return RuntimeData{}, &ParseError{Start: res.StartDate, End: res.EndDate, Thermostat: rl.ID, Row: i + 1, Err: err}
 			}
 			rd.Data = append(rd.Data, data)
 		}
 	}
 
-	// arrangement:
-	// sensors: [ { id: "rs:100:1", name: "Bedroom", type: "occupancy" }, ... ]
-	// columns: [ "date", "time", "rs:100:1", "rs:100:2", "rs2:100:1", ... ]
-	// data: [ "2020-02-09,19:00:00,71..4,...", ... ]
-	//
-	// need to split data, match to column index, and if it's a sensor ID, match to sensor
-
 	for _, sl := range res.SensorList {
-		ss := make(map[string]sensor)
-		for _, s := range sl.Sensors {
-			ss[s.ID] = s
-		}
-
-		for _, s := range sl.Data {
-			fields := strings.Split(s, ",")
-
-			date := fields[0]
-			tm := fields[1]
-			fields = fields[2:]
-			columns := sl.Columns[2:]
-
-			for i, f := range fields {
-				if sensor, ok := ss[columns[i]]; ok {
-					data := map[string]interface{}{
-						"date":       date,
-						"time":       tm,
-						"type":       "sensor",
-						"@timestamp": date + "T" + tm,
-						"sensor": map[string]string{
-							"id":    sensor.ID,
-							"name":  sensor.Name,
-							"type":  sensor.Type,
-							"usage": sensor.Usage,
-						},
-					}
-
-					// https://www.ecobee.com/home/developer/api/documentation/v1/objects/RuntimeSensorMetadata.shtml
-					switch sensor.Type {
-					case "occupancy", "dryContact":
-						if f == "0" {
-							data[sensor.Type] = false
-						} else {
-							data[sensor.Type] = true
-						}
-					case "temperature":
-						if num, err := strconv.ParseFloat(f, 64); err == nil {
-							data[sensor.Type] = num
-						} else {
-							data[sensor.Type] = f
-						}
-					case "co2", "ctclamp", "humidity", "plug", "pulsedElectricityMeter":
-						if num, err := strconv.Atoi(f); err == nil {
-							data[sensor.Type] = num
-						} else { // failed to convert
-							data[sensor.Type] = f
-						}
-					default:
-						data[sensor.Type] = f
-					}
-
-					rd.SensorData = append(rd.SensorData, data)
-				}
+		ss := sensorIndex(sl.Sensors)
+		for i, s := range sl.Data {
+			data, err := parseSensorRow(sl.ID, sl.Columns, ss, s)
+			if err != nil {
+				return RuntimeData{}, &ParseError{Start: res.StartDate, End: res.EndDate, Thermostat: sl.ID, Row: i + 1, Err: err}
 			}
+			rd.SensorData = append(rd.SensorData, data...)
 		}
 	}
 
 	return rd, nil
 }
+
+// splits a report row into its date, time, and remaining value fields
+func splitRow(row string) (string, string, []string, error) {
+	fields := strings.Split(row, ",")
+	if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+		return "", "", nil, fmt.Errorf("row is missing date and time: %q", row)
+	}
+	return fields[0], fields[1], fields[2:], nil
+}
+
+// converts a single reportList row from thermostat into a document. Rows
+// shorter than the column list only carry the columns present; empty
+// values are left out
+func parseReportRow(thermostat string, cols []string, row string) (map[string]interface{}, error) {
+	date, tm, fields, err := splitRow(row)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"date":       date,
+		"time":       tm,
+		"@timestamp": date + "T" + tm,
+		"type":       DocThermostat,
+	}
+	if thermostat != "" {
+		data["thermostat"] = thermostat
+	}
+	for j, c := range cols {
+		if j >= len(fields) {
+			break
+		}
+		if c == "" || fields[j] == "" {
+			continue
+		}
+		data[c] = convert(columnKinds[strings.ToLower(c)], fields[j])
+	}
+	return data, nil
+}
+
+// converts a report value to the kind of its column. Values that don't
+// convert are kept as strings
+func convert(kind string, v string) interface{} {
+	switch kind {
+	case KindInteger:
+		if num, err := strconv.Atoi(v); err == nil {
+			return num
+		}
+	case KindFloat:
+		if num, err := strconv.ParseFloat(v, 64); err == nil {
+			return num
+		}
+	case KindBoolean:
+		return v != "0"
+	}
+	return v
+}
+
+func sensorIndex(sensors []sensor) map[string]sensor {
+	ss := make(map[string]sensor, len(sensors))
+	for _, s := range sensors {
+		ss[s.ID] = s
+	}
+	return ss
+}
+
+// converts a single sensorList data row from thermostat into one document
+// per sensor reading.
+//
+// arrangement:
+// sensors: [ { id: "rs:100:1", name: "Bedroom", type: "occupancy" }, ... ]
+// columns: [ "date", "time", "rs:100:1", "rs:100:2", "rs2:100:1", ... ]
+// data: [ "2020-02-09,19:00:00,71..4,...", ... ]
+//
+// need to split data, match to column index, and if it's a sensor ID, match to sensor
+func parseSensorRow(thermostat string, columns []string, ss map[string]sensor, row string) ([]map[string]interface{}, error) {
+	if len(columns) < 2 {
+		return nil, fmt.Errorf("sensor columns missing date and time: %v", columns)
+	}
+	date, tm, fields, err := splitRow(row)
+	if err != nil {
+		return nil, err
+	}
+	columns = columns[2:]
+
+	docs := make([]map[string]interface{}, 0, len(fields))
+	for i, f := range fields {
+		if i >= len(columns) {
+			break
+		}
+		sensor, ok := ss[columns[i]]
+		if !ok || f == "" {
+			continue
+		}
+		data := map[string]interface{}{
+			"date":       date,
+			"time":       tm,
+			"type":       DocSensor,
+			"@timestamp": date + "T" + tm,
+			"sensor": map[string]string{
+				"id":    sensor.ID,
+				"name":  sensor.Name,
+				"type":  sensor.Type,
+				"usage": sensor.Usage,
+			},
+		}
+
+		if thermostat != "" {
+			data["thermostat"] = thermostat
+		}
+		data[sensor.Type] = convert(sensorKinds[sensor.Type], f)
+
+		docs = append(docs, data)
+	}
+	return docs, nil
+}
@@ -0,0 +1,280 @@
+package eco
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// renders documents one per line, as they are written to the archive
+func ndjson(t *testing.T, docs []map[string]interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, d := range docs {
+		if err := enc.Encode(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// decodes a response the way StreamRuntimeData does for a request over
+// 2020-02-01 -> 2020-02-02, collecting every document
+func stream(data []byte) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	rs := runtimeStream{
+		dec:   json.NewDecoder(bytes.NewReader(data)),
+		start: "2020-02-01",
+		end:   "2020-02-02",
+		fn: func(doc map[string]interface{}) error {
+			docs = append(docs, doc)
+			return nil
+		},
+	}
+	return docs, rs.decode()
+}
+
+// each testdata/<name>.json is a recorded runtimeReport response, and
+// testdata/<name>.ndjson the documents it should be archived as
+func TestRuntimeGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no recorded responses in testdata")
+	}
+	for _, file := range files {
+		file := file
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rd, err := parseRuntime(data)
+			if err != nil {
+				t.Fatalf("parseRuntime: %v", err)
+			}
+			got := ndjson(t, append(rd.Data, rd.SensorData...))
+
+			streamed, err := stream(data)
+			if err != nil {
+				t.Fatalf("stream: %v", err)
+			}
+			if s := ndjson(t, streamed); !bytes.Equal(s, got) {
+				t.Errorf("stream and parseRuntime disagree.\nstream:\n%s\nparseRuntime:\n%s", s, got)
+			}
+
+			golden := filepath.Join("testdata", name+".ndjson")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("documents differ from %s.\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestRuntimeParseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		thermostat string
+		row        int
+	}{
+		{
+			name:       "report row without time",
+			body:       `{"startDate":"2020-02-01","endDate":"2020-02-02","columns":"zoneAveTemp","reportList":[{"thermostatIdentifier":"311000000001","rowList":["2020-02-01,00:00:00,70","2020-02-01,,70"]}],"status":{"code":0}}`,
+			thermostat: "311000000001",
+			row:        2,
+		},
+		{
+			name:       "sensor columns without date",
+			body:       `{"startDate":"2020-02-01","endDate":"2020-02-02","columns":"","sensorList":[{"thermostatIdentifier":"311000000002","sensors":[],"columns":["date"],"data":["2020-02-01,00:00:00"]}],"status":{"code":0}}`,
+			thermostat: "311000000002",
+			row:        1,
+		},
+		{
+			name: "not an object",
+			body: `[]`,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, perr := parseRuntime([]byte(tc.body))
+			_, serr := stream([]byte(tc.body))
+			for src, err := range map[string]error{"parseRuntime": perr, "stream": serr} {
+				var pe *ParseError
+				if !errors.As(err, &pe) {
+					t.Fatalf("%s: expected a *ParseError, got %v", src, err)
+				}
+				if pe.Thermostat != tc.thermostat || pe.Row != tc.row {
+					t.Errorf("%s: error at thermostat %q row %d, expected %q row %d", src, pe.Thermostat, pe.Row, tc.thermostat, tc.row)
+				}
+				if tc.row > 0 && (pe.Start != "2020-02-01" || pe.End != "2020-02-02") {
+					t.Errorf("%s: error window %s -> %s, expected 2020-02-01 -> 2020-02-02", src, pe.Start, pe.End)
+				}
+			}
+		})
+	}
+}
+
+func requireParseError(t *testing.T, src string, err error) *ParseError {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("%s returned %T, expected a *ParseError: %v", src, err, err)
+	}
+	return pe
+}
+
+func FuzzParseRuntime(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.json"))
+	for _, file := range files {
+		if data, err := os.ReadFile(file); err == nil {
+			f.Add(data)
+		}
+	}
+	f.Add([]byte(`{"columns":"a,b","reportList":[{"rowList":[","]}],"status":{"code":0}}`))
+	f.Add([]byte(`{"sensorList":[{"sensors":[{"sensorId":"x"}],"columns":["date","time","x"],"data":["d,t,"]}],"status":{}}`))
+	f.Add([]byte(`{"reportList":[{"rowList":[1]}]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := parseRuntime(data)
+		requireParseError(t, "parseRuntime", err)
+		_, err = stream(data)
+		requireParseError(t, "stream", err)
+	})
+}
+
+// a response laid out in the order ecobee sends it: columns ahead of the
+// rows, and identifiers ahead of the lists they describe
+type recorded struct {
+	StartDate  string           `json:"startDate"`
+	EndDate    string           `json:"endDate"`
+	Columns    string           `json:"columns"`
+	ReportList []recordedReport `json:"reportList,omitempty"`
+	SensorList []recordedSensor `json:"sensorList,omitempty"`
+	RequestStatus
+}
+
+type recordedReport struct {
+	ID   string   `json:"thermostatIdentifier"`
+	Rows []string `json:"rowList"`
+}
+
+type recordedSensor struct {
+	ID      string   `json:"thermostatIdentifier"`
+	Sensors []sensor `json:"sensors"`
+	Columns []string `json:"columns"`
+	Data    []string `json:"data"`
+}
+
+var fuzzSensors = []sensor{
+	{ID: "rs:100:1", Name: "Bedroom", Type: "temperature"},
+	{ID: "rs:100:2", Name: "Bedroom", Type: "occupancy"},
+}
+
+func marshal(t *testing.T, r recorded) []byte {
+	t.Helper()
+	r.StartDate, r.EndDate = "2020-02-01", "2020-02-02"
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// a row that fails to parse must fail the whole response, pointing at it
+func checkRowError(t *testing.T, rowErr error, data []byte) {
+	t.Helper()
+	_, perr := parseRuntime(data)
+	_, serr := stream(data)
+	for src, err := range map[string]error{"parseRuntime": perr, "stream": serr} {
+		pe := requireParseError(t, src, err)
+		if rowErr == nil {
+			if pe != nil {
+				t.Fatalf("%s failed on a row that parses: %v", src, pe)
+			}
+			continue
+		}
+		if pe == nil {
+			t.Fatalf("%s accepted a row that fails: %v", src, rowErr)
+		}
+		if pe.Start != "2020-02-01" || pe.End != "2020-02-02" || pe.Thermostat != "311000000001" || pe.Row != 1 {
+			t.Fatalf("%s: error does not identify the window, thermostat and row: %v", src, pe)
+		}
+	}
+}
+
+func FuzzParseReportRow(f *testing.F) {
+	f.Add("zoneAveTemp,hvacMode,zoneOccupancy", "2020-02-01,00:00:00,70.5,heat,1")
+	f.Add("zoneAveTemp", "2020-02-01,00:00:00,,,")
+	f.Add("", ",")
+	f.Add("a,,b", "2020-02-01")
+
+	f.Fuzz(func(t *testing.T, cols string, row string) {
+		doc, err := parseReportRow("311000000001", strings.Split(cols, ","), row)
+		if err == nil {
+			for _, k := range []string{"date", "time", "@timestamp", "type", "thermostat"} {
+				if v, ok := doc[k].(string); !ok || v == "" {
+					t.Fatalf("document is missing %s: %v", k, doc)
+				}
+			}
+			for k, v := range doc {
+				if v == "" {
+					t.Fatalf("empty value kept for %s: %v", k, doc)
+				}
+			}
+		}
+		checkRowError(t, err, marshal(t, recorded{
+			Columns:    cols,
+			ReportList: []recordedReport{{ID: "311000000001", Rows: []string{row}}},
+		}))
+	})
+}
+
+func FuzzParseSensorRow(f *testing.F) {
+	f.Add("date,time,rs:100:1,rs:100:2", "2020-02-01,00:00:00,71.4,1")
+	f.Add("date,time,rs:100:1,rs:100:2", "2020-02-01,00:00:00,,")
+	f.Add("date", "2020-02-01,00:00:00")
+	f.Add("date,time,rs:999:1", ",,")
+
+	f.Fuzz(func(t *testing.T, cols string, row string) {
+		columns := strings.Split(cols, ",")
+		docs, err := parseSensorRow("311000000001", columns, sensorIndex(fuzzSensors), row)
+		for _, doc := range docs {
+			s, ok := doc["sensor"].(map[string]string)
+			if !ok {
+				t.Fatalf("document is missing its sensor: %v", doc)
+			}
+			if v, ok := doc[s["type"]]; !ok || v == "" {
+				t.Fatalf("document is missing a %s reading: %v", s["type"], doc)
+			}
+		}
+		checkRowError(t, err, marshal(t, recorded{
+			SensorList: []recordedSensor{{ID: "311000000001", Sensors: fuzzSensors, Columns: columns, Data: []string{row}}},
+		}))
+	})
+}
@@ -0,0 +1,108 @@
+package eco
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TokenStore persists an App's key, tokens and thermostat list
+type TokenStore interface {
+	Load() (*App, error)
+	Save(a *App) error
+}
+
+// Locker is implemented by stores that may be shared between processes.
+// App holds the lock across a refresh, and while saving. Lock gives up
+// waiting for another holder once ctx is done
+type Locker interface {
+	Lock(ctx context.Context) (unlock func() error, err error)
+}
+
+// the longest App waits for another process to release the store, e.g.
+// one stuck in a refresh against an unresponsive ecobee
+var lockTimeout = time.Minute
+
+// locks the store, giving up when ctx is done or after lockTimeout
+func lockStore(ctx context.Context, l Locker) (func() error, error) {
+	ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	unlock, err := l.Lock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("locking token store: %w", err)
+	}
+	return unlock, nil
+}
+
+// returned from Save by stores that can't be written to
+var ErrReadOnlyStore = errors.New("token store is read-only")
+
+func Open() (*App, error) {
+	return OpenStore(FileStore{Path: DefaultPath()})
+}
+
+func OpenFile(path string) (*App, error) {
+	return OpenStore(FileStore{Path: path})
+}
+
+// OpenStore loads an App from s, and saves it back there
+func OpenStore(s TokenStore) (*App, error) {
+	a, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	a.store = s
+	return a, nil
+}
+
+// Store is where the app is saved, a FileStore at DefaultPath unless
+// opened from elsewhere
+func (a *App) Store() TokenStore {
+	if a.store == nil {
+		return FileStore{Path: DefaultPath()}
+	}
+	return a.store
+}
+
+func (a *App) SetStore(s TokenStore) {
+	a.store = s
+}
+
+// Save writes the app to its store. If another process saved newer tokens
+// in the meantime, those are kept
+func (a *App) Save() error {
+	return a.SaveContext(context.Background())
+}
+
+// SaveContext is Save, giving up on waiting for the store's lock when ctx
+// is done
+func (a *App) SaveContext(ctx context.Context) error {
+	store := a.Store()
+	if l, ok := store.(Locker); ok {
+		unlock, err := lockStore(ctx, l)
+		if err != nil {
+			return err
+		}
+		defer unlock() // nolint
+
+		if cur, err := store.Load(); err == nil && cur.RefreshIssued.After(a.RefreshIssued) {
+			a.adopt(cur)
+		}
+	}
+	return store.Save(a)
+}
+
+// takes the tokens from a copy of the app read back from its store. An
+// invalidation recorded here stands unless cur's tokens were issued after
+// it, meaning another process authorized again: only SetTokens clears one
+func (a *App) adopt(cur *App) {
+	if a.Invalid == nil || cur.RefreshIssued.After(a.Invalid.At) {
+		a.Invalid = cur.Invalid
+	}
+	a.AccessToken = cur.AccessToken
+	a.RefreshToken = cur.RefreshToken
+	a.AccessExpires = cur.AccessExpires
+	a.RefreshIssued = cur.RefreshIssued
+	a.Scope = cur.Scope
+}
@@ -0,0 +1,213 @@
+package eco
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DirStore keeps each field in its own file within Dir, the layout used
+// for mounted container secrets:
+//
+//	app_key
+//	access_token
+//	refresh_token
+//	thermostats     one thermostat ID per line (optional)
+//	access_expires  RFC 3339 (optional)
+//	refresh_issued  RFC 3339 (optional)
+//	scope           smartRead, smartWrite or ems (optional)
+//	invalid         RFC 3339 time, then the reason, when ecobee rejected the tokens
+//
+// Saves replace every file at once, the way Kubernetes updates mounted
+// secrets: a complete set is written to a hidden directory, a ..data
+// symlink is switched over to it with a single rename, and each file is a
+// symlink into ..data. Neither readers nor a crash mid-save can see an
+// access token from one save alongside a refresh token from another. A
+// directory of plain files is converted on its first save.
+//
+// Set ReadOnly for directories mounted read-only, where refreshed tokens
+// are kept only for the life of the process
+type DirStore struct {
+	Dir      string
+	ReadOnly bool
+}
+
+// the symlink to the directory holding the current files
+const dataLink = "..data"
+
+func (s DirStore) Load() (*App, error) {
+	var a App
+	var err error
+
+	// read every file from the same save, even if another lands meanwhile
+	if target, err := os.Readlink(filepath.Join(s.Dir, dataLink)); err == nil {
+		s.Dir = filepath.Join(s.Dir, target)
+	}
+
+	if a.AppKey, err = s.read("app_key", true); err != nil {
+		return nil, err
+	}
+	if a.AccessToken, err = s.read("access_token", false); err != nil {
+		return nil, err
+	}
+	if a.RefreshToken, err = s.read("refresh_token", false); err != nil {
+		return nil, err
+	}
+
+	ts, err := s.read("thermostats", false)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range strings.Fields(ts) {
+		a.Thermostats = append(a.Thermostats, t)
+	}
+
+	if a.AccessExpires, err = s.readTime("access_expires"); err != nil {
+		return nil, err
+	}
+	if a.RefreshIssued, err = s.readTime("refresh_issued"); err != nil {
+		return nil, err
+	}
+
+	if a.Scope, err = s.read("scope", false); err != nil {
+		return nil, err
+	}
+
+	inv, err := s.read("invalid", false)
+	if err != nil {
+		return nil, err
+	}
+	if inv != "" {
+		parts := strings.SplitN(inv, "\n", 2)
+		at, err := time.Parse(time.RFC3339, parts[0])
+		if err != nil {
+			return nil, err
+		}
+		a.Invalid = &Invalidation{At: at}
+		if len(parts) == 2 {
+			a.Invalid.Reason = parts[1]
+		}
+	}
+	return &a, nil
+}
+
+func (s DirStore) Save(a *App) error {
+	if s.ReadOnly {
+		return ErrReadOnlyStore
+	}
+	files := map[string]string{
+		"app_key":        a.AppKey,
+		"access_token":   a.AccessToken,
+		"refresh_token":  a.RefreshToken,
+		"thermostats":    strings.Join(a.Thermostats, "\n"),
+		"access_expires": formatTime(a.AccessExpires),
+		"refresh_issued": formatTime(a.RefreshIssued),
+		"scope":          a.Scope,
+		"invalid":        "",
+	}
+	if a.Invalid != nil {
+		files["invalid"] = formatTime(a.Invalid.At) + "\n" + a.Invalid.Reason
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(s.Dir, "..save-")
+	if err != nil {
+		return err
+	}
+	for name, v := range files {
+		if err := writeSynced(filepath.Join(tmp, name), []byte(v)); err != nil {
+			os.RemoveAll(tmp) // nolint
+			return err
+		}
+	}
+
+	old, _ := os.Readlink(filepath.Join(s.Dir, dataLink))
+	if err := symlinkAtomic(filepath.Base(tmp), filepath.Join(s.Dir, dataLink)); err != nil {
+		os.RemoveAll(tmp) // nolint
+		return err
+	}
+	for name := range files {
+		if err := s.link(name); err != nil {
+			return err
+		}
+	}
+	if old != "" {
+		return os.RemoveAll(filepath.Join(s.Dir, old))
+	}
+	return nil
+}
+
+// makes name a symlink into ..data, unless it already is one
+func (s DirStore) link(name string) error {
+	path := filepath.Join(s.Dir, name)
+	target := filepath.Join(dataLink, name)
+	if cur, err := os.Readlink(path); err == nil && cur == target {
+		return nil
+	}
+	return symlinkAtomic(target, path)
+}
+
+// points the symlink at path to target, replacing whatever is there in a
+// single rename
+func symlinkAtomic(target string, path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp) // nolint: left by an earlier crash, if anything
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s DirStore) Lock(ctx context.Context) (func() error, error) {
+	l, err := lockFile(ctx, filepath.Join(s.Dir, ".lock"))
+	if err != nil {
+		return nil, err
+	}
+	return l.unlock, nil
+}
+
+func (s DirStore) read(name string, required bool) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, name))
+	if os.IsNotExist(err) && !required {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s DirStore) readTime(name string) (time.Time, error) {
+	v, err := s.read(name, false)
+	if err != nil || v == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
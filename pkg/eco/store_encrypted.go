@@ -0,0 +1,132 @@
+package eco
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters recommended for interactive logins as of 2017
+const (
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+// EncryptedFileStore keeps the app as JSON sealed with AES-256-GCM, under a
+// key derived from a passphrase with scrypt. It is locked and written the
+// same way as FileStore
+type EncryptedFileStore struct {
+	Path       string
+	Passphrase []byte
+}
+
+// NewKeyFileStore reads the passphrase for an EncryptedFileStore from
+// keyFile, ignoring surrounding whitespace
+func NewKeyFileStore(path string, keyFile string) (EncryptedFileStore, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return EncryptedFileStore{}, err
+	}
+	pass := []byte(strings.TrimSpace(string(key)))
+	if len(pass) == 0 {
+		return EncryptedFileStore{}, fmt.Errorf("key file %s is empty", keyFile)
+	}
+	return EncryptedFileStore{Path: path, Passphrase: pass}, nil
+}
+
+// on-disk format
+type sealed struct {
+	Version int    `json:"v"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+func (s EncryptedFileStore) Load() (*App, error) {
+	raw, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var env sealed
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, err
+	}
+	if env.Version != 1 || env.KDF != "scrypt" {
+		return nil, fmt.Errorf("%s: unsupported encryption version %d (%s)", s.Path, env.Version, env.KDF)
+	}
+
+	gcm, err := s.cipher(env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gcm.Open(nil, env.Nonce, env.Data, nil)
+	if err != nil {
+		return nil, errors.New("unable to decrypt token store: wrong passphrase or corrupted file")
+	}
+
+	var a App
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s EncryptedFileStore) Save(a *App) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	env := sealed{Version: 1, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16)}
+	if _, err := io.ReadFull(rand.Reader, env.Salt); err != nil {
+		return err
+	}
+	gcm, err := s.cipher(env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return err
+	}
+	env.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, env.Nonce); err != nil {
+		return err
+	}
+	env.Data = gcm.Seal(nil, env.Nonce, data, nil)
+
+	out, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.Path, out)
+}
+
+func (s EncryptedFileStore) Lock(ctx context.Context) (func() error, error) {
+	return FileStore{Path: s.Path}.Lock(ctx)
+}
+
+func (s EncryptedFileStore) cipher(salt []byte, n, r, p int) (cipher.AEAD, error) {
+	if len(s.Passphrase) == 0 {
+		return nil, errors.New("no passphrase for encrypted token store")
+	}
+	key, err := scrypt.Key(s.Passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
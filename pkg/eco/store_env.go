@@ -0,0 +1,58 @@
+package eco
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// EnvStore reads the app from environment variables, with names like
+// ECOBEE_APP_KEY for the default prefix of ECOBEE_:
+//
+//	<prefix>APP_KEY
+//	<prefix>ACCESS_TOKEN
+//	<prefix>REFRESH_TOKEN
+//	<prefix>THERMOSTATS     comma-separated thermostat IDs (optional)
+//	<prefix>ACCESS_EXPIRES  RFC 3339 (optional)
+//	<prefix>SCOPE           smartRead, smartWrite or ems (optional)
+//
+// It is read-only: refreshed tokens live only as long as the process
+type EnvStore struct {
+	Prefix string
+}
+
+func (s EnvStore) prefix() string {
+	if s.Prefix == "" {
+		return "ECOBEE_"
+	}
+	return s.Prefix
+}
+
+func (s EnvStore) Load() (*App, error) {
+	p := s.prefix()
+	a := App{
+		AppKey:       os.Getenv(p + "APP_KEY"),
+		AccessToken:  os.Getenv(p + "ACCESS_TOKEN"),
+		RefreshToken: os.Getenv(p + "REFRESH_TOKEN"),
+		Scope:        os.Getenv(p + "SCOPE"),
+	}
+	if a.AppKey == "" {
+		return nil, errors.New(p + "APP_KEY is not set")
+	}
+	if t := os.Getenv(p + "THERMOSTATS"); t != "" {
+		a.Thermostats = strings.Split(t, ",")
+	}
+	if e := os.Getenv(p + "ACCESS_EXPIRES"); e != "" {
+		exp, err := time.Parse(time.RFC3339, e)
+		if err != nil {
+			return nil, err
+		}
+		a.AccessExpires = exp
+	}
+	return &a, nil
+}
+
+func (s EnvStore) Save(a *App) error {
+	return ErrReadOnlyStore
+}
@@ -0,0 +1,103 @@
+package eco
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const filename = "app.json"
+
+// DefaultPath is where Open looks for the app: app.json in the working
+// directory if there is one (where earlier versions kept it), otherwise
+// elastibee/app.json under the user config dir ($XDG_CONFIG_HOME, or
+// ~/.config on Linux)
+func DefaultPath() string {
+	if _, err := os.Stat(filename); err == nil {
+		return filename
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filename
+	}
+	return filepath.Join(dir, "elastibee", filename)
+}
+
+// ProfilePath is where the app for a named profile is kept by default:
+// elastibee/profiles/<name>.json under the user config dir. The unnamed
+// profile is at DefaultPath
+func ProfilePath(name string) string {
+	if name == "" {
+		return DefaultPath()
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join("profiles", name+".json")
+	}
+	return filepath.Join(dir, "elastibee", "profiles", name+".json")
+}
+
+// FileStore keeps the app as plain JSON, replacing the file atomically on
+// every save
+type FileStore struct {
+	Path string
+}
+
+func (s FileStore) Load() (*App, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var a App
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s FileStore) Save(a *App) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.Path, data)
+}
+
+func (s FileStore) Lock(ctx context.Context) (func() error, error) {
+	l, err := lockFile(ctx, s.Path+".lock")
+	if err != nil {
+		return nil, err
+	}
+	return l.unlock, nil
+}
+
+// WriteFileAtomic writes to a temporary file alongside path and renames it
+// into place, so readers never see a partial file. The file is only
+// readable by its owner
+func WriteFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint: no-op once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
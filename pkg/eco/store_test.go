@@ -0,0 +1,220 @@
+package eco
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockFileContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.json.lock")
+	held, err := lockFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := lockFile(ctx, path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait for a held lock to time out, got %v", err)
+	}
+
+	if err := held.unlock(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := lockFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("lock not released: %v", err)
+	}
+	l.unlock() // nolint
+}
+
+func TestSaveLockTimeout(t *testing.T) {
+	store := FileStore{Path: filepath.Join(t.TempDir(), "app.json")}
+	unlock, err := store.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock() // nolint
+
+	a := &App{AppKey: "key", store: store}
+
+	// bounded even without a deadline of its own
+	defer func(d time.Duration) { lockTimeout = d }(lockTimeout)
+	lockTimeout = 100 * time.Millisecond
+	if err := a.Save(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Save to give up on the held lock, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.SaveContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected SaveContext to stop with its context, got %v", err)
+	}
+}
+
+func TestDirStoreSave(t *testing.T) {
+	dir := t.TempDir()
+	// a directory laid out by hand, before any save
+	for name, v := range map[string]string{"app_key": "key", "refresh_token": "refresh-0"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := DirStore{Dir: dir}
+	a, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.AppKey != "key" || a.RefreshToken != "refresh-0" {
+		t.Fatalf("loaded %+v from plain files", a)
+	}
+
+	for i := 1; i <= 2; i++ {
+		a.AccessToken = fmt.Sprintf("access-%d", i)
+		a.RefreshToken = fmt.Sprintf("refresh-%d", i)
+		if err := store.Save(a); err != nil {
+			t.Fatalf("save %d: %v", i, err)
+		}
+	}
+
+	cur, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.AppKey != "key" || cur.AccessToken != "access-2" || cur.RefreshToken != "refresh-2" {
+		t.Errorf("loaded %q, %q, %q after saving", cur.AppKey, cur.AccessToken, cur.RefreshToken)
+	}
+
+	// every file now comes from the one directory ..data points at, and
+	// earlier saves are cleaned up
+	target, err := os.Readlink(filepath.Join(dir, dataLink))
+	if err != nil {
+		t.Fatalf("no %s link: %v", dataLink, err)
+	}
+	for _, name := range []string{"app_key", "access_token", "refresh_token"} {
+		if l, err := os.Readlink(filepath.Join(dir, name)); err != nil || l != filepath.Join(dataLink, name) {
+			t.Errorf("%s is not a link into %s: %q, %v", name, dataLink, l, err)
+		}
+	}
+	saves, err := filepath.Glob(filepath.Join(dir, "..save-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saves) != 1 || filepath.Base(saves[0]) != target {
+		t.Errorf("expected only the current save to remain, have %v", saves)
+	}
+}
+
+func TestSaveKeepsInvalidation(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		issued  time.Time // of the tokens another process saved
+		invalid bool      // expected after saving
+	}{
+		{"tokens refreshed before the rejection", now.Add(-time.Minute), true},
+		{"authorized again after the rejection", now.Add(time.Minute), false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store := FileStore{Path: filepath.Join(t.TempDir(), "app.json")}
+			other := &App{AppKey: "key", AccessToken: "access-2", RefreshToken: "refresh-2", RefreshIssued: tc.issued}
+			if err := store.Save(other); err != nil {
+				t.Fatal(err)
+			}
+
+			a := &App{AppKey: "key", AccessToken: "access-1", RefreshToken: "refresh-1", RefreshIssued: now.Add(-time.Hour), store: store}
+			a.Invalid = &Invalidation{Reason: "deauthorized", At: now}
+			if err := a.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			cur, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cur.RefreshToken != "refresh-2" {
+				t.Errorf("newer tokens were not kept: %q", cur.RefreshToken)
+			}
+			if got := cur.Invalid != nil; got != tc.invalid {
+				t.Errorf("saved invalidation %v, expected one: %v", cur.Invalid, tc.invalid)
+			}
+		})
+	}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.enc")
+	store := EncryptedFileStore{Path: path, Passphrase: []byte("correct horse")}
+	a := &App{AppKey: "key", AccessToken: "access-1", RefreshToken: "refresh-1", Scope: "smartRead", Thermostats: []string{"311000000001"}}
+	if err := store.Save(a); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "refresh-1") {
+		t.Fatal("refresh token stored in the clear")
+	}
+
+	cur, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.AppKey != "key" || cur.AccessToken != "access-1" || cur.RefreshToken != "refresh-1" || cur.Scope != "smartRead" || len(cur.Thermostats) != 1 {
+		t.Errorf("loaded %+v, expected what was saved", cur)
+	}
+
+	if _, err := (EncryptedFileStore{Path: path, Passphrase: []byte("wrong horse")}).Load(); err == nil {
+		t.Error("loaded with the wrong passphrase")
+	}
+
+	// one bit of the sealed tokens flipped
+	var env sealed
+	if err := json.Unmarshal(raw, &env); err != nil {
+		t.Fatal(err)
+	}
+	env.Data[len(env.Data)/2] ^= 1
+	tampered, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err == nil {
+		t.Error("loaded a tampered file")
+	}
+}
+
+func TestEnvStore(t *testing.T) {
+	t.Setenv("TEST_ECOBEE_APP_KEY", "key")
+	t.Setenv("TEST_ECOBEE_ACCESS_TOKEN", "access-1")
+	t.Setenv("TEST_ECOBEE_REFRESH_TOKEN", "refresh-1")
+	t.Setenv("TEST_ECOBEE_THERMOSTATS", "311000000001,311000000002")
+	t.Setenv("TEST_ECOBEE_ACCESS_EXPIRES", "2020-02-01T00:00:00Z")
+	store := EnvStore{Prefix: "TEST_ECOBEE_"}
+
+	a, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.AppKey != "key" || a.AccessToken != "access-1" || a.RefreshToken != "refresh-1" || len(a.Thermostats) != 2 || a.AccessExpires.IsZero() {
+		t.Errorf("loaded %+v from the environment", a)
+	}
+
+	a.SetStore(store)
+	if err := a.Save(); !errors.Is(err, ErrReadOnlyStore) {
+		t.Errorf("expected ErrReadOnlyStore saving to the environment, got %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package eco
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// StreamRuntimeData fetches the runtime report for the given dates like
+// GetRuntimeData, but decodes the response incrementally and hands each
+// thermostat and sensor document to fn as soon as its row is read, rather
+// than holding the whole report in memory. Returning an error from fn stops
+// the stream.
+func (a *App) StreamRuntimeData(start string, end string, fn func(doc map[string]interface{}) error) error {
+	return a.StreamRuntimeDataContext(context.Background(), start, end, fn)
+}
+
+func (a *App) StreamRuntimeDataContext(ctx context.Context, start string, end string, fn func(doc map[string]interface{}) error) error {
+	query, err := a.runtimeQuery(ctx, start, end)
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkValid(); err != nil {
+		return err
+	}
+	if err := a.ensureFresh(ctx); err != nil {
+		return err
+	}
+
+	url := "/1/runtimeReport?" + query
+	for refreshes := 0; ; refreshes++ {
+		res, err := send(ctx, a.API(), "GET", url, nil, a.AccessToken)
+		if err != nil {
+			return err
+		}
+
+		rs := runtimeStream{
+			dec:   json.NewDecoder(res.Body),
+			start: start,
+			end:   end,
+			fn:    fn,
+		}
+		err = rs.decode()
+		res.Body.Close()
+		if err != nil {
+			if _, ok := err.(*ParseError); ok && res.StatusCode != http.StatusOK {
+				return badResponse(endpoint(url), res.StatusCode, err)
+			}
+			return err
+		}
+
+		err = statusError(url, res.StatusCode, rs.status)
+		if errors.Is(err, ErrTokenExpired) && rs.sent == 0 && refreshes < maxRefreshes {
+			if err := a.RefreshContext(ctx); err != nil {
+				return fmt.Errorf("access token expired. Got error when refreshing: %w", err)
+			}
+			continue
+		}
+		return a.rejected(err)
+	}
+}
+
+type runtimeStream struct {
+	dec    *json.Decoder
+	start  string
+	end    string
+	fn     func(map[string]interface{}) error
+	cols   []string
+	status RequestStatus
+	sent   int
+}
+
+func (rs *runtimeStream) fail(thermostat string, row int, err error) error {
+	if _, ok := err.(*ParseError); ok {
+		return err
+	}
+	return &ParseError{Start: rs.start, End: rs.end, Thermostat: thermostat, Row: row, Err: err}
+}
+
+func (rs *runtimeStream) emit(doc map[string]interface{}) error {
+	rs.sent++
+	return rs.fn(doc)
+}
+
+// walks the top-level response object. ecobee sends columns ahead of the
+// report lists, and the status last
+func (rs *runtimeStream) decode() error {
+	if err := rs.expect('{'); err != nil {
+		return rs.fail("", 0, err)
+	}
+	seenStatus := false
+	for rs.dec.More() {
+		key, err := rs.key()
+		if err != nil {
+			return rs.fail("", 0, err)
+		}
+		switch key {
+		case "columns":
+			var cols string
+			if err := rs.dec.Decode(&cols); err != nil {
+				return rs.fail("", 0, err)
+			}
+			rs.cols = strings.Split(cols, ",")
+		case "reportList":
+			if err := rs.list(rs.report); err != nil {
+				return err
+			}
+		case "sensorList":
+			if err := rs.list(rs.sensors); err != nil {
+				return err
+			}
+		case "status":
+			if err := rs.dec.Decode(&rs.status.Status); err != nil {
+				return rs.fail("", 0, err)
+			}
+			seenStatus = true
+		default:
+			if err := rs.skip(); err != nil {
+				return rs.fail("", 0, err)
+			}
+		}
+	}
+	if err := rs.expect('}'); err != nil {
+		return rs.fail("", 0, err)
+	}
+	if !seenStatus {
+		return rs.fail("", 0, errors.New("response is missing a status"))
+	}
+	return nil
+}
+
+// iterates over a JSON array, calling elem for each member
+func (rs *runtimeStream) list(elem func() error) error {
+	if err := rs.expect('['); err != nil {
+		return rs.fail("", 0, err)
+	}
+	for rs.dec.More() {
+		if err := elem(); err != nil {
+			return err
+		}
+	}
+	if err := rs.expect(']'); err != nil {
+		return rs.fail("", 0, err)
+	}
+	return nil
+}
+
+// decodes one reportList entry, emitting a document per row
+func (rs *runtimeStream) report() error {
+	var id string
+	if err := rs.expect('{'); err != nil {
+		return rs.fail(id, 0, err)
+	}
+	for rs.dec.More() {
+		key, err := rs.key()
+		if err != nil {
+			return rs.fail(id, 0, err)
+		}
+		switch key {
+		case "thermostatIdentifier":
+			if err := rs.dec.Decode(&id); err != nil {
+				return rs.fail(id, 0, err)
+			}
+		case "rowList":
+			if rs.cols == nil {
+				return rs.fail(id, 0, errors.New("rowList received before columns"))
+			}
+			row := 0
+			err := rs.list(func() error {
+				row++
+				var r string
+				if err := rs.dec.Decode(&r); err != nil {
+					return rs.fail(id, row, err)
+				}
+				data, err := parseReportRow(id, rs.cols, r)
+				if err != nil {
+					return rs.fail(id, row, err)
+				}
+				return rs.emit(data)
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			if err := rs.skip(); err != nil {
+				return rs.fail(id, 0, err)
+			}
+		}
+	}
+	if err := rs.expect('}'); err != nil {
+		return rs.fail(id, 0, err)
+	}
+	return nil
+}
+
+// decodes one sensorList entry, emitting a document per sensor reading
+func (rs *runtimeStream) sensors() error {
+	var (
+		id      string
+		ss      map[string]sensor
+		columns []string
+	)
+	if err := rs.expect('{'); err != nil {
+		return rs.fail(id, 0, err)
+	}
+	for rs.dec.More() {
+		key, err := rs.key()
+		if err != nil {
+			return rs.fail(id, 0, err)
+		}
+		switch key {
+		case "thermostatIdentifier":
+			if err := rs.dec.Decode(&id); err != nil {
+				return rs.fail(id, 0, err)
+			}
+		case "sensors":
+			var list []sensor
+			if err := rs.dec.Decode(&list); err != nil {
+				return rs.fail(id, 0, err)
+			}
+			ss = sensorIndex(list)
+		case "columns":
+			if err := rs.dec.Decode(&columns); err != nil {
+				return rs.fail(id, 0, err)
+			}
+		case "data":
+			if ss == nil || columns == nil {
+				return rs.fail(id, 0, errors.New("sensor data received before sensors and columns"))
+			}
+			row := 0
+			err := rs.list(func() error {
+				row++
+				var r string
+				if err := rs.dec.Decode(&r); err != nil {
+					return rs.fail(id, row, err)
+				}
+				docs, err := parseSensorRow(id, columns, ss, r)
+				if err != nil {
+					return rs.fail(id, row, err)
+				}
+				for _, d := range docs {
+					if err := rs.emit(d); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			if err := rs.skip(); err != nil {
+				return rs.fail(id, 0, err)
+			}
+		}
+	}
+	if err := rs.expect('}'); err != nil {
+		return rs.fail(id, 0, err)
+	}
+	return nil
+}
+
+func (rs *runtimeStream) expect(d json.Delim) error {
+	t, err := rs.dec.Token()
+	if err != nil {
+		return err
+	}
+	if got, ok := t.(json.Delim); !ok || got != d {
+		return fmt.Errorf("expected %q, got %v", d, t)
+	}
+	return nil
+}
+
+func (rs *runtimeStream) key() (string, error) {
+	t, err := rs.dec.Token()
+	if err != nil {
+		return "", err
+	}
+	k, ok := t.(string)
+	if !ok {
+		return "", fmt.Errorf("expected object key, got %v", t)
+	}
+	return k, nil
+}
+
+func (rs *runtimeStream) skip() error {
+	var v json.RawMessage
+	return rs.dec.Decode(&v)
+}
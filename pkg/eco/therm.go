@@ -1,6 +1,7 @@
 package eco
 
 import (
+	"context"
 	"encoding/json"
 	"net/url"
 )
@@ -24,6 +25,10 @@ type thermostatResponse struct {
 }
 
 func (a *App) GetThermostats() ([]Thermostat, error) {
+	return a.GetThermostatsContext(context.Background())
+}
+
+func (a *App) GetThermostatsContext(ctx context.Context) ([]Thermostat, error) {
 
 	req, err := json.Marshal(map[string]map[string]string{
 		"selection": map[string]string{
@@ -37,7 +42,7 @@ func (a *App) GetThermostats() ([]Thermostat, error) {
 	params := url.Values{}
 	params.Add("json", string(req))
 
-	body, err := a.fetch("GET", "/1/thermostat?"+params.Encode(), nil)
+	body, err := a.fetch(ctx, "GET", "/1/thermostat?"+params.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,90 @@
+package eco
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/auth"
+)
+
+const (
+	// refresh access tokens this long before ecobee says they expire
+	refreshAhead = 5 * time.Minute
+
+	// ecobee expires refresh tokens that go unused for a year
+	RefreshTokenLifetime = 365 * 24 * time.Hour
+
+	// how long before that RefreshExpiresSoon starts reporting it, and
+	// requests start refreshing proactively to keep the token alive
+	RefreshWarnWindow = 30 * 24 * time.Hour
+)
+
+// SetTokens stores newly authorized tokens along with when they expire.
+// Tokens granted a broader scope than the app asked for are refused with
+// ErrScopeTooBroad. It does not save the app
+func (a *App) SetTokens(tk auth.TokenResponse) error {
+	if tk.AccessToken == "" || tk.Refresh == "" {
+		return errors.New("empty tokens in response")
+	}
+	if tk.Scope != "" {
+		if err := checkScope(tk.Scope, a.Scope); err != nil {
+			return err
+		}
+	}
+	return a.setTokens(tk)
+}
+
+// stores tokens without checking their scope
+func (a *App) setTokens(tk auth.TokenResponse) error {
+	if tk.AccessToken == "" || tk.Refresh == "" {
+		return errors.New("empty tokens in response")
+	}
+	now := time.Now()
+	a.AccessToken = tk.AccessToken
+	a.RefreshToken = tk.Refresh
+	a.RefreshIssued = now
+	a.Invalid = nil
+	if tk.Scope != "" {
+		a.Scope = tk.Scope
+	}
+	a.AccessExpires = time.Time{}
+	if tk.Expires > 0 {
+		a.AccessExpires = now.Add(time.Duration(tk.Expires) * time.Second)
+	}
+	return nil
+}
+
+// RefreshExpiry estimates when the refresh token will expire from inactivity.
+// Zero if it was never recorded
+func (a *App) RefreshExpiry() time.Time {
+	if a.RefreshIssued.IsZero() {
+		return time.Time{}
+	}
+	return a.RefreshIssued.Add(RefreshTokenLifetime)
+}
+
+// RefreshExpiresSoon reports whether the refresh token is within
+// RefreshWarnWindow of expiring, and when it does
+func (a *App) RefreshExpiresSoon() (time.Time, bool) {
+	exp := a.RefreshExpiry()
+	if exp.IsZero() {
+		return exp, false
+	}
+	return exp, time.Until(exp) < RefreshWarnWindow
+}
+
+// refreshes ahead of time when the access token is about to expire, or
+// the refresh token is getting close to its inactivity limit
+func (a *App) ensureFresh(ctx context.Context) error {
+	_, stale := a.RefreshExpiresSoon()
+	expiring := !a.AccessExpires.IsZero() && time.Until(a.AccessExpires) < refreshAhead
+	if !stale && !expiring {
+		return nil
+	}
+	if err := a.RefreshContext(ctx); err != nil {
+		return fmt.Errorf("refreshing tokens ahead of expiry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package eco
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/api"
+	"github.com/pzl/elastibee/pkg/auth"
+)
+
+func TestCheckScope(t *testing.T) {
+	tests := []struct {
+		granted string
+		allowed string
+		broad   bool
+	}{
+		{auth.ScopeRead, auth.ScopeRead, false},
+		{auth.ScopeWrite, auth.ScopeRead, true},
+		{auth.ScopeEMS, auth.ScopeRead, true},
+		{"", auth.ScopeRead, true}, // saved before scopes were recorded
+		{auth.ScopeRead, auth.ScopeWrite, false},
+		{auth.ScopeEMS, auth.ScopeWrite, false},
+		{auth.ScopeWrite, "", false},
+	}
+	for _, tc := range tests {
+		a := &App{Scope: tc.granted}
+		err := a.CheckScope(tc.allowed)
+		if got := errors.Is(err, ErrScopeTooBroad); got != tc.broad {
+			t.Errorf("%q tokens with %q allowed: got %v", tc.granted, tc.allowed, err)
+		}
+	}
+}
+
+func TestSetTokensScope(t *testing.T) {
+	a := &App{Scope: auth.ScopeRead, AccessToken: "access-1", RefreshToken: "refresh-1"}
+	err := a.SetTokens(auth.TokenResponse{AccessToken: "access-2", Refresh: "refresh-2", Scope: auth.ScopeWrite})
+	if !errors.Is(err, ErrScopeTooBroad) {
+		t.Fatalf("expected smartWrite tokens to be refused when smartRead was asked for, got %v", err)
+	}
+	if a.AccessToken != "access-1" || a.Scope != auth.ScopeRead {
+		t.Errorf("refused tokens were kept: %q, %q", a.AccessToken, a.Scope)
+	}
+
+	if err := a.SetTokens(auth.TokenResponse{AccessToken: "access-3", Refresh: "refresh-3", Scope: auth.ScopeRead}); err != nil {
+		t.Fatal(err)
+	}
+	if a.AccessToken != "access-3" || a.Scope != auth.ScopeRead {
+		t.Errorf("granted tokens not taken: %q, %q", a.AccessToken, a.Scope)
+	}
+
+	// asking for more than is granted is fine
+	a = &App{Scope: auth.ScopeWrite}
+	if err := a.SetTokens(auth.TokenResponse{AccessToken: "access", Refresh: "refresh", Scope: auth.ScopeRead}); err != nil {
+		t.Fatal(err)
+	}
+	if a.Scope != auth.ScopeRead {
+		t.Errorf("granted scope not recorded: %q", a.Scope)
+	}
+}
+
+func TestReadOnlyWrite(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+	c, err := api.New(api.Options{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{AppKey: "key", AccessToken: "access", RefreshToken: "refresh", Scope: auth.ScopeRead, RefreshIssued: time.Now()}
+	a.SetAPI(c)
+
+	_, err = a.fetch(context.Background(), "POST", "/1/thermostat?format=json", []byte(`{}`))
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected a write with smartRead tokens to fail with ErrReadOnly, got %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("%d requests reached ecobee", n)
+	}
+	if a.CanWrite() {
+		t.Error("smartRead tokens reported as able to write")
+	}
+}
@@ -0,0 +1,171 @@
+package eco
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/api"
+)
+
+const (
+	maxAttempts  = 5                      // per request, including the first
+	maxRefreshes = 1                      // refresh-and-retry cycles per request on an expired token
+	backoffBase  = 500 * time.Millisecond // doubled on every retry
+	backoffMax   = 30 * time.Second
+)
+
+// ecobee doesn't publish hard numbers, but throttles and eventually blocks
+// apps that hammer the API, asking them to keep to modest polling rates.
+// All requests from this package share one bucket.
+var limiter = newTokenBucket(time.Second, 3)
+
+// SetRateLimit changes the shared limit on ecobee requests to a burst of
+// burst requests, refilling at one request per interval
+func SetRateLimit(interval time.Duration, burst int) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.every = interval
+	limiter.burst = float64(burst)
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+}
+
+// sends the request, retrying with exponential backoff and jitter when it
+// times out, or the server fails with a 5xx or 429 that isn't a definitive
+// ecobee status (anything but StatusProcessErr). Once retries are exhausted
+// the last response or error is returned
+func send(ctx context.Context, c *api.Client, method string, url string, body []byte, token string) (*http.Response, error) {
+	var (
+		res *http.Response
+		err error
+	)
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+		if err := limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		var rd io.Reader
+		if body != nil {
+			rd = bytes.NewReader(body)
+		}
+		res, err = rawstream(ctx, c, method, url, rd, token)
+		if err != nil {
+			if timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		if res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return res, nil
+		}
+
+		// ecobee reports most API errors as a 500 with a status body, so
+		// look inside before deciding the failure is transient. Error
+		// bodies are small enough to hold on to
+		buf, rerr := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		if rerr != nil {
+			continue
+		}
+		var status RequestStatus
+		if json.Unmarshal(buf, &status) == nil && status.Status.Code != StatusSuccess && status.Status.Code != StatusProcessErr {
+			return res, nil
+		}
+	}
+	return res, err
+}
+
+// full-jitter exponential backoff for the given retry number (1-based)
+func backoff(attempt int) time.Duration {
+	d := backoffBase << uint(attempt-1)
+	if d > backoffMax || d <= 0 {
+		d = backoffMax
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// like time.Sleep, but gives up early with the context's error
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func timeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	every  time.Duration
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(every time.Duration, burst int) *tokenBucket {
+	return &tokenBucket{
+		every:  every,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// blocks until a request may be made, or the context is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	if b.every > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.every)
+	} else {
+		b.tokens = b.burst
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	// take the token now, even if it goes negative, so waiters queue up in
+	// order rather than all waking at once
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens * float64(b.every))
+	}
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	if err := sleep(ctx, delay); err != nil {
+		// hand the unused token back
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// AliasAction is one change made by UpdateAliases. Set one of its fields
+type AliasAction struct {
+	Add         *AliasTarget `json:"add,omitempty"`
+	Remove      *AliasTarget `json:"remove,omitempty"`
+	RemoveIndex *AliasTarget `json:"remove_index,omitempty"` // deletes the index
+}
+
+type AliasTarget struct {
+	Index string `json:"index"`
+	Alias string `json:"alias,omitempty"`
+}
+
+func (c Client) AliasIndices(alias string) ([]string, error) {
+	return c.AliasIndicesContext(context.Background(), alias)
+}
+
+// AliasIndicesContext lists the indices behind alias, sorted. None when
+// there's no such alias
+func (c Client) AliasIndicesContext(ctx context.Context, alias string) ([]string, error) {
+	res, err := c.do(ctx, "GET", "/_alias/"+alias, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+
+	var ar map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&ar); err != nil {
+		return nil, fmt.Errorf("unable to decode alias response: %w", err)
+	}
+	indices := make([]string, 0, len(ar))
+	for idx := range ar {
+		indices = append(indices, idx)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (c Client) UpdateAliases(actions ...AliasAction) error {
+	return c.UpdateAliasesContext(context.Background(), actions...)
+}
+
+// UpdateAliasesContext applies actions atomically: all of them, or none
+func (c Client) UpdateAliasesContext(ctx context.Context, actions ...AliasAction) error {
+	return c.call(ctx, "POST", "/_aliases", map[string][]AliasAction{"actions": actions}, nil)
+}
@@ -0,0 +1,345 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaults for BulkIndexerOptions, well under Elasticsearch's 100MB
+// http.max_content_length and quick enough to send within the timeouts
+const (
+	DefaultFlushDocs     = 1000
+	DefaultFlushBytes    = 5 << 20
+	DefaultFlushInterval = 5 * time.Second
+	DefaultWorkers       = 2
+)
+
+// the shortest period the flush interval is checked at
+const minTick = time.Millisecond
+
+type BulkIndexerOptions struct {
+	Index         string        // for items that don't name their own
+	FlushDocs     int           // send once this many documents are waiting
+	FlushBytes    int           // or the request body reaches this size
+	FlushInterval time.Duration // or the oldest waiting document is this old. Negative never
+	Workers       int           // requests in flight at once
+}
+
+// BulkItem is one document for a BulkIndexer
+type BulkItem struct {
+	Action string      // index (default) or create
+	Index  string      // overrides the indexer's
+	ID     string      // optional; Elasticsearch picks one otherwise
+	Doc    interface{} // marshalled to JSON, or json.RawMessage as-is
+}
+
+// BulkIndexer batches documents into _bulk requests sent by a pool of
+// workers. Add blocks while every worker is busy and a batch is already
+// waiting, so a fast producer can't run away from the cluster.
+//
+// Rejected documents don't stop indexing; they are collected into the
+// *BulkError returned by Close. Creating a document whose ID is already
+// stored isn't a rejection either, so creates can safely be run again. A
+// failed request does stop indexing, and its error is returned from then on
+type BulkIndexer struct {
+	client Client
+	opts   BulkIndexerOptions
+	ctx    context.Context
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	docs    int  // waiting in buf
+	first   int  // position of the first of them
+	ids     bool // whether every one of them has an ID
+	added   int
+	since   time.Time // when the oldest waiting document was added
+	err     error     // first request failure
+	rejects []BulkItemError
+	stats   BulkStats
+
+	queue  chan batch
+	wg     sync.WaitGroup
+	stop   chan struct{}
+	ticked chan struct{} // closed once tick has returned
+}
+
+type batch struct {
+	body  []byte
+	docs  int
+	first int
+	ids   bool // safe to send again: every document has an ID
+}
+
+// BulkStats counts what a BulkIndexer has done so far
+type BulkStats struct {
+	Added    int // documents accepted by Add
+	Indexed  int // stored by Elasticsearch
+	Failed   int // rejected by Elasticsearch, or lost with a failed request
+	Existing int // created with an ID already stored, so left as they were
+	Requests int // _bulk requests sent
+	Bytes    int // request body bytes sent
+}
+
+// NewBulkIndexer starts an indexer whose requests run under ctx. Close it
+// to send what remains and stop the workers
+func (c Client) NewBulkIndexer(ctx context.Context, o BulkIndexerOptions) *BulkIndexer {
+	if o.FlushDocs <= 0 {
+		o.FlushDocs = DefaultFlushDocs
+	}
+	if o.FlushBytes <= 0 {
+		o.FlushBytes = DefaultFlushBytes
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = DefaultFlushInterval
+	}
+	if o.Workers <= 0 {
+		o.Workers = DefaultWorkers
+	}
+
+	bi := &BulkIndexer{
+		client: c,
+		opts:   o,
+		ctx:    ctx,
+		queue:  make(chan batch, o.Workers),
+		stop:   make(chan struct{}),
+		ticked: make(chan struct{}),
+	}
+	bi.wg.Add(o.Workers)
+	for i := 0; i < o.Workers; i++ {
+		go bi.work()
+	}
+	if o.FlushInterval > 0 {
+		go bi.tick()
+	} else {
+		close(bi.ticked)
+	}
+	return bi
+}
+
+// Add queues a document, sending a batch when it fills up. It must not be
+// called once Close has been
+func (bi *BulkIndexer) Add(ctx context.Context, item BulkItem) error {
+	line, err := bulkLines(item)
+	if err != nil {
+		return err
+	}
+
+	bi.mu.Lock()
+	if bi.err != nil {
+		bi.mu.Unlock()
+		return bi.err
+	}
+	if bi.docs > 0 && bi.buf.Len()+len(line) > bi.opts.FlushBytes {
+		b := bi.take()
+		bi.mu.Unlock()
+		if err := bi.send(ctx, b); err != nil {
+			return err
+		}
+		bi.mu.Lock()
+	}
+	if bi.docs == 0 {
+		bi.since = time.Now()
+		bi.first = bi.added
+		bi.ids = true
+	}
+	bi.ids = bi.ids && item.ID != ""
+	bi.buf.Write(line)
+	bi.docs++
+	bi.added++
+	bi.stats.Added++
+
+	var b batch
+	full := bi.docs >= bi.opts.FlushDocs || bi.buf.Len() >= bi.opts.FlushBytes
+	if full {
+		b = bi.take()
+	}
+	bi.mu.Unlock()
+
+	if full {
+		return bi.send(ctx, b)
+	}
+	return nil
+}
+
+// Close sends any waiting documents, waits for the requests in flight, and
+// reports the first request failure, or else the documents rejected
+func (bi *BulkIndexer) Close(ctx context.Context) error {
+	close(bi.stop)
+	<-bi.ticked
+
+	bi.mu.Lock()
+	b := bi.take()
+	failed := bi.err != nil
+	bi.mu.Unlock()
+
+	var err error
+	if b.docs > 0 {
+		if failed {
+			bi.lost(b, nil)
+		} else {
+			err = bi.send(ctx, b)
+		}
+	}
+	close(bi.queue)
+	bi.wg.Wait()
+
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	if bi.err != nil {
+		return bi.err
+	}
+	if err != nil {
+		return err
+	}
+	if len(bi.rejects) > 0 {
+		return &BulkError{Total: bi.added, Items: bi.rejects}
+	}
+	return nil
+}
+
+// Stats returns the counts so far
+func (bi *BulkIndexer) Stats() BulkStats {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	return bi.stats
+}
+
+// hands the waiting documents over as a batch. Caller holds bi.mu
+func (bi *BulkIndexer) take() batch {
+	b := batch{body: append([]byte(nil), bi.buf.Bytes()...), docs: bi.docs, first: bi.first, ids: bi.ids}
+	bi.buf.Reset()
+	bi.docs = 0
+	return b
+}
+
+// queues a batch for the workers, waiting for room
+func (bi *BulkIndexer) send(ctx context.Context, b batch) error {
+	select {
+	case bi.queue <- b:
+		return nil
+	case <-ctx.Done():
+		bi.lost(b, ctx.Err())
+		return ctx.Err()
+	case <-bi.ctx.Done():
+		bi.lost(b, bi.ctx.Err())
+		return bi.ctx.Err()
+	}
+}
+
+func (bi *BulkIndexer) work() {
+	defer bi.wg.Done()
+	for b := range bi.queue {
+		bi.mu.Lock()
+		failed := bi.err != nil
+		bi.mu.Unlock()
+		if failed {
+			bi.lost(b, nil) // don't pile more requests onto a failing cluster
+			continue
+		}
+
+		err := bi.client.bulk(bi.ctx, bi.opts.Index, bytes.NewReader(b.body), b.ids)
+
+		bi.mu.Lock()
+		bi.stats.Requests++
+		bi.stats.Bytes += len(b.body)
+		var be *BulkError
+		switch {
+		case err == nil:
+			bi.stats.Indexed += b.docs
+		case errors.As(err, &be):
+			for _, item := range be.Items {
+				if item.Exists() {
+					bi.stats.Existing++
+					continue
+				}
+				item.Position += b.first
+				bi.rejects = append(bi.rejects, item)
+				bi.stats.Failed++
+			}
+			bi.stats.Indexed += b.docs - len(be.Items)
+		default:
+			bi.stats.Failed += b.docs
+			if bi.err == nil {
+				bi.err = err
+			}
+		}
+		bi.mu.Unlock()
+	}
+}
+
+// counts a batch that was never sent, recording why
+func (bi *BulkIndexer) lost(b batch, err error) {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	bi.stats.Failed += b.docs
+	if bi.err == nil && err != nil {
+		bi.err = err
+	}
+}
+
+// sends waiting documents once the oldest has waited FlushInterval
+func (bi *BulkIndexer) tick() {
+	defer close(bi.ticked)
+	period := bi.opts.FlushInterval / 4
+	if period < minTick {
+		period = minTick
+	}
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-bi.stop:
+			return
+		case <-t.C:
+		}
+		bi.mu.Lock()
+		due := bi.docs > 0 && bi.err == nil && time.Since(bi.since) >= bi.opts.FlushInterval
+		var b batch
+		if due {
+			b = bi.take()
+		}
+		bi.mu.Unlock()
+		if !due {
+			continue
+		}
+		// Close waits for this before closing the queue
+		select {
+		case bi.queue <- b:
+		case <-bi.ctx.Done():
+			bi.lost(b, bi.ctx.Err())
+			return
+		}
+	}
+}
+
+// encodes the action and source lines for an item
+func bulkLines(item BulkItem) ([]byte, error) {
+	action := item.Action
+	if action == "" {
+		action = "index"
+	}
+	meta := make(map[string]string)
+	if item.Index != "" {
+		meta["_index"] = item.Index
+	}
+	if item.ID != "" {
+		meta["_id"] = item.ID
+	}
+	head, err := json.Marshal(map[string]map[string]string{action: meta})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := json.Marshal(item.Doc)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(head)+len(doc)+2)
+	line = append(line, head...)
+	line = append(line, '\n')
+	line = append(line, doc...)
+	return append(line, '\n'), nil
+}
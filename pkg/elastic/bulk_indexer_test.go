@@ -0,0 +1,182 @@
+package elastic_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pzl/elastibee/pkg/elastic"
+	"github.com/pzl/elastibee/pkg/elastic/elastictest"
+)
+
+// documents of the same size, so batches can be worked out by bytes:
+// {"index":{}}\n{"n":1007}\n is 24 bytes
+func fixedDoc(n int) elastic.BulkItem {
+	return elastic.BulkItem{Doc: json.RawMessage(fmt.Sprintf(`{"n":%d}`, 1000+n))}
+}
+
+const fixedLine = 24
+
+func indexAll(t *testing.T, srv *elastictest.Server, o elastic.BulkIndexerOptions, docs int) (elastic.BulkStats, error) {
+	t.Helper()
+	ctx := context.Background()
+	bi := elastic.New(srv.URL).NewBulkIndexer(ctx, o)
+	for i := 0; i < docs; i++ {
+		if err := bi.Add(ctx, fixedDoc(i)); err != nil {
+			t.Fatalf("Add %d: %v", i, err)
+		}
+	}
+	err := bi.Close(ctx)
+	return bi.Stats(), err
+}
+
+func TestBulkIndexerFlushDocs(t *testing.T) {
+	srv := elastictest.NewServer()
+	defer srv.Close()
+
+	stats, err := indexAll(t, srv, elastic.BulkIndexerOptions{Index: "eco", FlushDocs: 10, FlushInterval: -1}, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two full batches, and the rest on Close
+	if stats.Requests != 3 || srv.BulkRequests() != 3 {
+		t.Errorf("expected 3 bulk requests, stats report %d and the server got %d", stats.Requests, srv.BulkRequests())
+	}
+	want := elastic.BulkStats{Added: 25, Indexed: 25, Requests: 3, Bytes: 25 * fixedLine}
+	if stats != want {
+		t.Errorf("stats %+v, expected %+v", stats, want)
+	}
+	if n := len(srv.Docs("eco")); n != 25 {
+		t.Errorf("%d documents stored, expected 25", n)
+	}
+}
+
+func TestBulkIndexerFlushInterval(t *testing.T) {
+	// down to intervals shorter than the ticker could be set to
+	for _, interval := range []time.Duration{50 * time.Millisecond, time.Nanosecond} {
+		interval := interval
+		t.Run(interval.String(), func(t *testing.T) {
+			srv := elastictest.NewServer()
+			defer srv.Close()
+			ctx := context.Background()
+			bi := elastic.New(srv.URL).NewBulkIndexer(ctx, elastic.BulkIndexerOptions{Index: "eco", FlushInterval: interval})
+			for i := 0; i < 5; i++ {
+				if err := bi.Add(ctx, fixedDoc(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// sent while still open, with the batch far from full
+			deadline := time.Now().Add(5 * time.Second)
+			for len(srv.Docs("eco")) < 5 {
+				if time.Now().After(deadline) {
+					t.Fatalf("%d documents stored after waiting, expected 5", len(srv.Docs("eco")))
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err := bi.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if stats := bi.Stats(); stats.Indexed != 5 {
+				t.Errorf("stats %+v, expected 5 indexed", stats)
+			}
+		})
+	}
+}
+
+func TestBulkIndexerFlushBytes(t *testing.T) {
+	srv := elastictest.NewServer()
+	defer srv.Close()
+
+	// 4 documents fit under 100 bytes, a fifth doesn't
+	stats, err := indexAll(t, srv, elastic.BulkIndexerOptions{Index: "eco", FlushBytes: 100, FlushInterval: -1}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := elastic.BulkStats{Added: 20, Indexed: 20, Requests: 5, Bytes: 20 * fixedLine}
+	if stats != want {
+		t.Errorf("stats %+v, expected %+v", stats, want)
+	}
+	if srv.BulkRequests() != 5 {
+		t.Errorf("server got %d bulk requests, expected 5", srv.BulkRequests())
+	}
+	if n := len(srv.Docs("eco")); n != 20 {
+		t.Errorf("%d documents stored, expected 20", n)
+	}
+}
+
+func TestBulkIndexerRejects(t *testing.T) {
+	srv := elastictest.NewServer()
+	defer srv.Close()
+	srv.BulkFailure = func(index string, doc map[string]interface{}) *elastictest.ItemError {
+		if int(doc["n"].(float64)-1000)%5 == 0 {
+			return &elastictest.ItemError{Type: "mapper_parsing_exception", Reason: "failed to parse field [n]"}
+		}
+		return nil
+	}
+
+	stats, err := indexAll(t, srv, elastic.BulkIndexerOptions{Index: "eco", FlushDocs: 7, FlushInterval: -1}, 25)
+	var be *elastic.BulkError
+	if !errors.As(err, &be) {
+		t.Fatalf("expected a *BulkError, got %v", err)
+	}
+	if be.Total != 25 {
+		t.Errorf("BulkError counts %d items, expected 25", be.Total)
+	}
+
+	// positions count across every batch the indexer sent
+	var positions []int
+	for _, item := range be.Items {
+		positions = append(positions, item.Position)
+		if item.Status != 400 || item.Type != "mapper_parsing_exception" {
+			t.Errorf("unexpected item error %+v", item)
+		}
+	}
+	sort.Ints(positions)
+	if fmt.Sprint(positions) != "[0 5 10 15 20]" {
+		t.Errorf("rejected positions %v, expected [0 5 10 15 20]", positions)
+	}
+	if stats.Indexed != 20 || stats.Failed != 5 {
+		t.Errorf("stats %+v, expected 20 indexed and 5 failed", stats)
+	}
+	if n := len(srv.Docs("eco")); n != 20 {
+		t.Errorf("%d documents stored, expected 20", n)
+	}
+}
+
+func TestBulkIndexerExisting(t *testing.T) {
+	srv := elastictest.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+
+	// creating the same IDs again leaves the stored documents alone
+	for run := 1; run <= 2; run++ {
+		bi := elastic.New(srv.URL).NewBulkIndexer(ctx, elastic.BulkIndexerOptions{Index: "eco", FlushInterval: -1})
+		for i := 0; i < 10; i++ {
+			item := fixedDoc(i)
+			item.Action, item.ID = "create", fmt.Sprint(i)
+			if err := bi.Add(ctx, item); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bi.Close(ctx); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		want := elastic.BulkStats{Added: 10, Indexed: 10, Requests: 1}
+		if run == 2 {
+			want.Indexed, want.Existing = 0, 10
+		}
+		stats := bi.Stats()
+		stats.Bytes = 0
+		if stats != want {
+			t.Errorf("run %d: stats %+v, expected %+v", run, stats, want)
+		}
+	}
+	if n := len(srv.Docs("eco")); n != 10 {
+		t.Errorf("%d documents stored, expected 10", n)
+	}
+}
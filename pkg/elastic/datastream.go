@@ -0,0 +1,29 @@
+package elastic
+
+import (
+	"context"
+	"net/http"
+)
+
+func (c Client) CreateDataStream(name string) error {
+	return c.CreateDataStreamContext(context.Background(), name)
+}
+
+// CreateDataStreamContext creates an empty data stream. An index template
+// with a data_stream section must match name already
+func (c Client) CreateDataStreamContext(ctx context.Context, name string) error {
+	return c.call(ctx, "PUT", "/_data_stream/"+name, nil, nil)
+}
+
+func (c Client) DataStreamExists(name string) bool {
+	return c.DataStreamExistsContext(context.Background(), name)
+}
+
+func (c Client) DataStreamExistsContext(ctx context.Context, name string) bool {
+	res, err := c.do(ctx, "GET", "/_data_stream/"+name, nil, nil)
+	if err != nil {
+		return true
+	}
+	defer res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
@@ -1,46 +1,322 @@
 package elastic
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type Client struct {
-	Host string
-	http *http.Client
+	Host  string // the first node given
+	http  *http.Client
+	auth  string // Authorization header value, if any
+	nodes *pool
+	gzip  *compression // nil when not compressing
 }
 
+// Options configure how the client reaches and authenticates with the
+// cluster. At most one of the credentials may be set
+type Options struct {
+	Host       string
+	Hosts      []string     // more nodes, taking turns with Host
+	HTTPClient *http.Client // used as-is when set, ignoring the TLS settings
+
+	Username    string // basic auth, with Password
+	Password    string
+	APIKey      string // as encoded by Elasticsearch, or "id:api_key"
+	BearerToken string // e.g. from the token service or an OIDC provider
+
+	Gzip      bool // compress bulk and index creation request bodies
+	GzipLevel int  // 1 (fastest) to 9 (smallest), defaulting to gzip.DefaultCompression
+
+	CAFile             string // PEM certificates to trust besides the system's
+	CertFile           string // client certificate and key, PEM
+	KeyFile            string
+	InsecureSkipVerify bool // don't verify the server certificate at all
+}
+
+// New returns a client for host without authentication
 func New(host string) Client {
+	c, _ := NewWithOptions(Options{Host: host}) // nolint: fails only on TLS files, which aren't given
+	return c
+}
+
+// NewWithOptions returns a client spreading requests over o.Host and
+// o.Hosts, failing on conflicting credentials or unreadable certificate
+// files
+func NewWithOptions(o Options) (Client, error) {
+	hosts := o.Hosts
+	if o.Host != "" {
+		hosts = append([]string{o.Host}, hosts...)
+	}
+	c := Client{http: o.HTTPClient, nodes: newPool(hosts)}
+	if len(hosts) == 0 {
+		return c, errors.New("no elasticsearch hosts given")
+	}
+	c.Host = strings.TrimRight(hosts[0], "/")
+
+	set := 0
+	if o.Username != "" || o.Password != "" {
+		set++
+		c.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(o.Username+":"+o.Password))
+	}
+	if o.APIKey != "" {
+		set++
+		key := o.APIKey
+		if strings.Contains(key, ":") {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		c.auth = "ApiKey " + key
+	}
+	if o.BearerToken != "" {
+		set++
+		c.auth = "Bearer " + o.BearerToken
+	}
+	if set > 1 {
+		return c, errors.New("elasticsearch credentials conflict: set only one of username/password, API key or bearer token")
+	}
+	if o.Gzip {
+		level := o.GzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+			return c, err
+		}
+		c.gzip = &compression{level: level}
+	}
+	if c.http != nil {
+		return c, nil
+	}
+
+	tc, err := tlsConfig(o)
+	if err != nil {
+		return c, err
+	}
+
 	timeout := 20 * time.Second
 
-	return Client{
-		Host: host,
-		http: &http.Client{
-			Timeout: timeout,
-			Transport: &http.Transport{
-				Dial:                (&net.Dialer{Timeout: timeout}).Dial,
-				TLSHandshakeTimeout: timeout,
-			},
+	// no overall client timeout: bulk bodies may be streamed in while the
+	// source is still being read, so only bound the waits on the server
+	c.http = &http.Client{
+		Transport: &http.Transport{
+			Dial:                  (&net.Dialer{Timeout: timeout}).Dial,
+			TLSClientConfig:       tc,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
 		},
 	}
+	return c, nil
+}
+
+func tlsConfig(o Options) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify} // nolint
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", o.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
 }
 
 func (c Client) Bulk(idx string, body io.Reader) error {
-	req, err := http.NewRequest("POST", c.Host+"/"+idx+"/_bulk", body)
+	return c.BulkContext(context.Background(), idx, body)
+}
+
+// BulkContext sends a _bulk request. It isn't sent to another node after a
+// failure that may have left it applied, since documents without an ID
+// would be indexed twice
+func (c Client) BulkContext(ctx context.Context, idx string, body io.Reader) error {
+	return c.bulk(ctx, idx, body, false)
+}
+
+// sends a _bulk request, which is idempotent when every document in it
+// has an ID
+func (c Client) bulk(ctx context.Context, idx string, body io.Reader, idempotent bool) error {
+	h := http.Header{"Content-Type": {"application/x-ndjson"}}
+	body, done := c.compress(body, h)
+	defer done()
+	res, err := c.roundTrip(ctx, "POST", "/"+idx+"/_bulk", body, h, idempotent)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/x-ndjson")
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+
+	var br bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&br); err != nil {
+		return fmt.Errorf("unable to decode bulk response: %w", err)
+	}
+	if !br.Errors {
+		return nil
+	}
 
-	res, err := c.http.Do(req)
+	be := &BulkError{Total: len(br.Items)}
+	for i, item := range br.Items {
+		for _, r := range item { // keyed by action: index, create, ...
+			if r.Status < 300 {
+				continue
+			}
+			be.Items = append(be.Items, BulkItemError{
+				Position: i,
+				Status:   r.Status,
+				Type:     r.Error.Type,
+				Reason:   r.Error.Reason,
+			})
+		}
+	}
+	return be
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Index  string `json:"_index"`
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// BulkError reports the documents of a bulk request that Elasticsearch
+// rejected. The rest were indexed
+type BulkError struct {
+	Total int // items in the request
+	Items []BulkItemError
+}
+
+type BulkItemError struct {
+	Position int // of the document in the request, from 0
+	Status   int
+	Type     string
+	Reason   string
+}
+
+// Exists reports whether the item was a create for an ID already stored
+func (e BulkItemError) Exists() bool {
+	return e.Status == http.StatusConflict && e.Type == "version_conflict_engine_exception"
+}
+
+func (e *BulkError) Error() string {
+	if len(e.Items) == 0 {
+		return "bulk request reported errors"
+	}
+	first := e.Items[0]
+	return fmt.Sprintf("%d of %d bulk items failed. First (item %d): %s: %s", len(e.Items), e.Total, first.Position, first.Type, first.Reason)
+}
+
+// Error is a request Elasticsearch answered with a failure status. Type
+// and Reason come from the error in the response, if it had one; Body
+// holds the response otherwise
+type Error struct {
+	Status int
+	Method string
+	Path   string
+	Type   string // like index_not_found_exception
+	Reason string
+	Body   string
+}
+
+func (e *Error) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("elasticsearch %s %s: %d %s: %s", e.Method, e.Path, e.Status, e.Type, e.Reason)
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("elasticsearch %s %s: %d %s", e.Method, e.Path, e.Status, e.Reason)
+	}
+	return fmt.Sprintf("elasticsearch %s %s: %d %s", e.Method, e.Path, e.Status, strings.TrimSpace(e.Body))
+}
+
+// reads a failed response into an *Error
+func responseError(res *http.Response) error {
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
+	e := &Error{Status: res.StatusCode, Method: res.Request.Method, Path: res.Request.URL.Path}
+	var eb struct {
+		Error json.RawMessage `json:"error"`
+	}
+	var cause struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	switch {
+	case json.Unmarshal(body, &eb) != nil || len(eb.Error) == 0:
+		e.Body = string(body)
+	case json.Unmarshal(eb.Error, &cause) == nil:
+		e.Type, e.Reason = cause.Type, cause.Reason
+	default: // some APIs give just a message
+		if json.Unmarshal(eb.Error, &e.Reason) != nil {
+			e.Body = string(body)
+		}
+	}
+	return e
+}
 
-	// todo, check return values, statuses
+// sends in as a JSON body, if not nil, and decodes a 200 response into out,
+// if not nil. Other statuses are returned as an *Error
+func (c Client) call(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	var h http.Header
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		h = http.Header{"Content-Type": {"application/json"}}
+		r, done := c.compress(bytes.NewReader(data), h)
+		defer done()
+		body = r
+	}
+	res, err := c.do(ctx, method, path, body, h)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to decode %s response: %w", path, err)
+	}
 	return nil
 }
@@ -0,0 +1,209 @@
+package elastic_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pzl/elastibee/pkg/elastic"
+	"github.com/pzl/elastibee/pkg/elastic/elastictest"
+)
+
+func TestError(t *testing.T) {
+	srv := elastictest.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+	client := elastic.New(srv.URL)
+
+	tests := []struct {
+		name   string
+		err    error
+		method string
+		path   string
+		status int
+		typ    string
+	}{
+		{"call", client.RefreshContext(ctx, "missing"), "POST", "/missing/_refresh", http.StatusNotFound, "index_not_found_exception"},
+		{"create index", func() error {
+			client.CreateIndexContext(ctx, "eco", strings.NewReader("{}")) // nolint
+			return client.CreateIndexContext(ctx, "eco", strings.NewReader("{}"))
+		}(), "PUT", "/eco", http.StatusBadRequest, "resource_already_exists_exception"},
+		{"data stream without a template", client.CreateDataStreamContext(ctx, "logs"), "PUT", "/_data_stream/logs", http.StatusBadRequest, ""},
+		{"template", client.PutIndexTemplateContext(ctx, "eco", elastic.IndexTemplate{}), "PUT", "/_index_template/eco", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		var ee *elastic.Error
+		if !errors.As(tc.err, &ee) {
+			t.Errorf("%s: expected an *elastic.Error, got %v", tc.name, tc.err)
+			continue
+		}
+		if ee.Method != tc.method || ee.Path != tc.path || ee.Status != tc.status {
+			t.Errorf("%s: error for %s %s %d, expected %s %s %d", tc.name, ee.Method, ee.Path, ee.Status, tc.method, tc.path, tc.status)
+		}
+		if tc.typ != "" && ee.Type != tc.typ {
+			t.Errorf("%s: error type %q, expected %q", tc.name, ee.Type, tc.typ)
+		}
+		if ee.Type == "" || ee.Reason == "" {
+			t.Errorf("%s: no type and reason taken from the response: %+v", tc.name, ee)
+		}
+	}
+}
+
+func TestErrorNotElasticsearch(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+
+	err := elastic.New(proxy.URL).RefreshContext(context.Background(), "eco")
+	var ee *elastic.Error
+	if !errors.As(err, &ee) {
+		t.Fatalf("expected an *elastic.Error, got %v", err)
+	}
+	if ee.Status != http.StatusBadGateway || ee.Type != "" || strings.TrimSpace(ee.Body) != "upstream unavailable" {
+		t.Errorf("unexpected error %+v", ee)
+	}
+	if !strings.Contains(err.Error(), "upstream unavailable") {
+		t.Errorf("message leaves out the response: %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name string
+		opts elastic.Options
+		auth string // the Authorization header expected
+	}{
+		{"basic", elastic.Options{Username: "elastic", Password: "changeme"}, "Basic " + b64("elastic:changeme")},
+		{"API key, encoded", elastic.Options{APIKey: b64("VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw")}, "ApiKey " + b64("VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw")},
+		{"API key, id:api_key", elastic.Options{APIKey: "VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw"}, "ApiKey " + b64("VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw")},
+		{"bearer", elastic.Options{BearerToken: "dGhpcyBpcyBub3QgYSByZWFsIHRva2Vu"}, "Bearer dGhpcyBpcyBub3QgYSByZWFsIHRva2Vu"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srv := elastictest.NewServer()
+			defer srv.Close()
+			srv.Authorization = tc.auth
+			ctx := context.Background()
+
+			tc.opts.Host = srv.URL
+			c, err := elastic.NewWithOptions(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.CreateIndexContext(ctx, "eco", strings.NewReader("{}")); err != nil {
+				t.Fatalf("request with %s refused: %v", tc.auth, err)
+			}
+
+			var ee *elastic.Error
+			err = elastic.New(srv.URL).RefreshContext(ctx, "eco")
+			if !errors.As(err, &ee) || ee.Status != http.StatusUnauthorized {
+				t.Errorf("expected a 401 without credentials, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCredentialsConflict(t *testing.T) {
+	for name, o := range map[string]elastic.Options{
+		"basic and API key":   {Username: "elastic", Password: "changeme", APIKey: "id:key"},
+		"API key and bearer":  {APIKey: "id:key", BearerToken: "token"},
+		"password and bearer": {Password: "changeme", BearerToken: "token"},
+		"all three":           {Username: "elastic", APIKey: "id:key", BearerToken: "token"},
+	} {
+		o.Host = "http://localhost:9200"
+		if _, err := elastic.NewWithOptions(o); err == nil || !strings.Contains(err.Error(), "conflict") {
+			t.Errorf("%s: expected the credentials to conflict, got %v", name, err)
+		}
+	}
+}
+
+// writes the certificate and key srv presents to PEM files in dir
+func writeCert(t *testing.T, srv *httptest.Server, dir string) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(srv.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	// a node that insists on a client certificate
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"_shards":{"total":1,"successful":1,"failed":0}}`)) // nolint
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // refused handshakes are expected
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	// the node's own certificate, which is self-signed, serves as the CA
+	// and the client certificate alike
+	certFile, keyFile := writeCert(t, srv, dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	tests := []struct {
+		name string
+		opts elastic.Options
+		err  string // from NewWithOptions, if any
+		ok   bool   // whether the node accepts the connection
+	}{
+		{"CA and client certificate", elastic.Options{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}, "", true},
+		{"insecure, with a client certificate", elastic.Options{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}, "", true},
+		{"no client certificate", elastic.Options{CAFile: certFile}, "", false},
+		{"server not trusted", elastic.Options{CertFile: certFile, KeyFile: keyFile}, "", false},
+		{"CA file missing", elastic.Options{CAFile: missing}, "missing.pem", false},
+		{"CA file without certificates", elastic.Options{CAFile: notPEM}, "no PEM certificates", false},
+		{"client certificate without key", elastic.Options{CertFile: certFile}, "no such file", false},
+		{"key that isn't one", elastic.Options{CertFile: certFile, KeyFile: notPEM}, "key", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Host = srv.URL
+			c, err := elastic.NewWithOptions(tc.opts)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error mentioning %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.RefreshContext(context.Background(), "eco")
+			if tc.ok && err != nil {
+				t.Errorf("expected the node to answer: %v", err)
+			} else if !tc.ok && err == nil {
+				t.Error("expected the connection to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,1231 @@
+// Package elastictest provides an in-process fake of the small subset of
+// the Elasticsearch API elastibee uses. It keeps documents in memory so
+// archive runs can be checked without a cluster, and can reject chosen
+// bulk items to exercise error handling.
+package elastictest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	*httptest.Server
+
+	// BulkFailure, when set, is consulted for every bulk item. Returning a
+	// non-nil error rejects the item with it instead of storing the document
+	BulkFailure func(index string, doc map[string]interface{}) *ItemError
+
+	// Authorization, when set, is the header value every request must
+	// carry, such as "Basic ..." or "ApiKey ...". Others get a 401
+	Authorization string
+
+	// ReindexScript, when set, stands in for the painless script of a
+	// _reindex request, given its source and each document. It returns the
+	// document to write and the ctx.op the script set: "noop" skips the
+	// document, "delete" removes it from the destination, and anything
+	// else writes it. Without it, scripts are ignored
+	ReindexScript func(script string, doc map[string]interface{}) (map[string]interface{}, string)
+
+	// ReindexFailure, when set, is consulted for every document a _reindex
+	// copies. Returning a non-nil error leaves the document out, reported
+	// among the failures
+	ReindexFailure func(doc map[string]interface{}) *ItemError
+
+	// PublishAddresses are the node HTTP addresses _nodes/http reports, as
+	// host:port or hostname/ip:port. Defaults to the server's own
+	PublishAddresses []string
+
+	mu          sync.Mutex
+	indices     map[string]*Index
+	templates   map[string]*Template
+	dataStreams map[string]*DataStream
+	policies    map[string]json.RawMessage
+	tasks       map[string]json.RawMessage // finished reindex responses
+	bulks       int
+	gzipped     int
+}
+
+type Index struct {
+	Name         string
+	Settings     json.RawMessage // body the index was created with, or its template's
+	Aliases      []string
+	Docs         []Doc
+	WriteBlocked bool // index.blocks.write is set
+
+	ids map[string]int // position in Docs
+}
+
+// stores d, replacing any document with its ID. Reports whether it's new
+func (ix *Index) put(d Doc) bool {
+	if i, ok := ix.ids[d.ID]; ok {
+		ix.Docs[i] = d
+		return false
+	}
+	if ix.ids == nil {
+		ix.ids = make(map[string]int)
+	}
+	ix.ids[d.ID] = len(ix.Docs)
+	ix.Docs = append(ix.Docs, d)
+	return true
+}
+
+// removes the document with id, if there is one
+func (ix *Index) remove(id string) {
+	i, ok := ix.ids[id]
+	if !ok {
+		return
+	}
+	ix.Docs = append(ix.Docs[:i], ix.Docs[i+1:]...)
+	delete(ix.ids, id)
+	for j := i; j < len(ix.Docs); j++ {
+		ix.ids[ix.Docs[j].ID] = j
+	}
+}
+
+// Template is an index template installed through _index_template
+type Template struct {
+	Name       string
+	Patterns   []string
+	Priority   int
+	DataStream bool
+	Body       json.RawMessage // the template section
+}
+
+// DataStream is a data stream and the backing indices holding its
+// documents, the last being written to
+type DataStream struct {
+	Name     string
+	Template string
+	Indices  []string
+}
+
+type Doc struct {
+	ID     string
+	Source map[string]interface{}
+}
+
+// ItemError is the error reported for a rejected bulk item
+type ItemError struct {
+	Status int    `json:"-"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func NewServer() *Server {
+	s := newServer()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.route))
+	return s
+}
+
+func newServer() *Server {
+	return &Server{
+		indices:     make(map[string]*Index),
+		templates:   make(map[string]*Template),
+		dataStreams: make(map[string]*DataStream),
+		policies:    make(map[string]json.RawMessage),
+		tasks:       make(map[string]json.RawMessage),
+	}
+}
+
+// NewTLSServer starts a fake serving HTTPS with a self-signed certificate.
+// Certificate() returns it for trusting as a CA
+func NewTLSServer() *Server {
+	s := newServer()
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.route))
+	return s
+}
+
+// Docs returns the source of every document stored in idx, in order. An
+// alias or wildcard pattern gives the documents of each index it covers
+func (s *Server) Docs(idx string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var docs []map[string]interface{}
+	for _, ix := range s.resolve(idx) {
+		for _, d := range ix.Docs {
+			docs = append(docs, d.Source)
+		}
+	}
+	return docs
+}
+
+// Indices lists the names of every index, sorted
+func (s *Server) Indices() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.indices))
+	for name := range s.indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Template returns a copy of the named index template, or nil
+func (s *Server) Template(name string) *Template {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.templates[name]
+	if !ok {
+		return nil
+	}
+	cp := *t
+	return &cp
+}
+
+// DataStream returns a copy of the named data stream, or nil
+func (s *Server) DataStream(name string) *DataStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ds, ok := s.dataStreams[name]
+	if !ok {
+		return nil
+	}
+	cp := *ds
+	cp.Indices = append([]string(nil), ds.Indices...)
+	return &cp
+}
+
+// Policy returns the body of the named ILM policy, or nil
+func (s *Server) Policy(name string) json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policies[name]
+}
+
+// Index returns a copy of the named index, or nil if it doesn't exist
+func (s *Server) Index(idx string) *Index {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ix, ok := s.indices[idx]
+	if !ok {
+		return nil
+	}
+	cp := *ix
+	cp.Aliases = append([]string(nil), ix.Aliases...)
+	cp.Docs = append([]Doc(nil), ix.Docs...)
+	return &cp
+}
+
+// BulkRequests reports how many _bulk requests have been received
+func (s *Server) BulkRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bulks
+}
+
+// GzipRequests reports how many requests arrived with a gzipped body
+func (s *Server) GzipRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gzipped
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	if s.Authorization != "" && r.Header.Get("Authorization") != s.Authorization {
+		w.Header().Set("WWW-Authenticate", `Basic realm="security" charset="UTF-8"`)
+		errorResponse(w, http.StatusUnauthorized, "security_exception", "missing authentication credentials for REST request ["+r.URL.Path+"]")
+		return
+	}
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, "parse_exception", "invalid gzip body: "+err.Error())
+			return
+		}
+		defer zr.Close()
+		r.Body = zr
+		s.mu.Lock()
+		s.gzipped++
+		s.mu.Unlock()
+	default:
+		errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", "unsupported Content-Encoding ["+r.Header.Get("Content-Encoding")+"]")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "_bulk" && r.Method == "POST":
+		s.bulk(w, r, "")
+	case len(parts) == 1 && parts[0] == "_aliases" && r.Method == "POST":
+		s.updateAliases(w, r)
+	case len(parts) == 1 && parts[0] == "_reindex" && r.Method == "POST":
+		s.reindex(w, r)
+	case len(parts) == 2 && parts[0] == "_alias" && (r.Method == "GET" || r.Method == "HEAD"):
+		s.getAlias(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "_tasks" && r.Method == "GET":
+		s.getTask(w, r, parts[1])
+	case len(parts) == 2 && parts[1] == "_refresh" && (r.Method == "POST" || r.Method == "GET"):
+		s.refresh(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "_settings" && r.Method == "PUT":
+		s.putSettings(w, r, parts[0])
+	case len(parts) == 1 && parts[0] != "":
+		switch r.Method {
+		case "GET", "HEAD":
+			s.get(w, r, parts[0])
+		case "PUT":
+			s.create(w, r, parts[0])
+		case "DELETE":
+			s.delete(w, r, parts[0])
+		default:
+			methodNotAllowed(w, r)
+		}
+	case len(parts) == 2 && parts[0] == "_index_template":
+		switch r.Method {
+		case "GET", "HEAD":
+			s.getTemplate(w, r, parts[1])
+		case "PUT", "POST":
+			s.putTemplate(w, r, parts[1])
+		case "DELETE":
+			s.deleteTemplate(w, r, parts[1])
+		default:
+			methodNotAllowed(w, r)
+		}
+	case len(parts) == 2 && parts[0] == "_data_stream":
+		switch r.Method {
+		case "GET", "HEAD":
+			s.getDataStream(w, r, parts[1])
+		case "PUT":
+			s.createDataStream(w, r, parts[1])
+		case "DELETE":
+			s.deleteDataStream(w, r, parts[1])
+		default:
+			methodNotAllowed(w, r)
+		}
+	case len(parts) == 3 && parts[0] == "_ilm" && parts[1] == "policy":
+		switch r.Method {
+		case "GET", "HEAD":
+			s.getPolicy(w, r, parts[2])
+		case "PUT":
+			s.putPolicy(w, r, parts[2])
+		default:
+			methodNotAllowed(w, r)
+		}
+	case len(parts) == 2 && parts[0] == "_nodes" && parts[1] == "http":
+		s.nodes(w, r)
+	case len(parts) == 2 && parts[1] == "_bulk" && (r.Method == "POST" || r.Method == "PUT"):
+		s.bulk(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "_mapping" && (r.Method == "GET" || r.Method == "HEAD"):
+		s.mapping(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "_count":
+		s.count(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "_search":
+		s.search(w, r, parts[0])
+	default:
+		errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("no handler found for uri [%s] and method [%s]", r.URL.Path, r.Method))
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, idx string) {
+	s.mu.Lock()
+	ixs := s.resolve(idx)
+	res := make(map[string]json.RawMessage, len(ixs))
+	for _, ix := range ixs {
+		res[ix.Name] = settings(ix)
+	}
+	s.mu.Unlock()
+	if len(ixs) == 0 {
+		notFound(w, idx)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request, idx string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 && !json.Valid(body) {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", "request body is not valid JSON")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.indices[idx]; ok {
+		errorResponse(w, http.StatusBadRequest, "resource_already_exists_exception", fmt.Sprintf("index [%s] already exists", idx))
+		return
+	}
+	if _, err := s.newIndex(idx, body); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid_alias_name_exception", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true, "index": idx})
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, idx string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.indices[idx]; !ok {
+		notFound(w, idx)
+		return
+	}
+	delete(s.indices, idx)
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+func (s *Server) bulk(w http.ResponseWriter, r *http.Request, defaultIdx string) {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/x-ndjson") && !strings.HasPrefix(ct, "application/json") {
+		errorResponse(w, http.StatusNotAcceptable, "media_type_header_exception", "Content-Type header ["+ct+"] is not supported")
+		return
+	}
+
+	type result struct {
+		Index  string     `json:"_index"`
+		ID     string     `json:"_id"`
+		Status int        `json:"status"`
+		Result string     `json:"result,omitempty"`
+		Error  *ItemError `json:"error,omitempty"`
+	}
+	var (
+		items  []map[string]result
+		errors bool
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bulks++
+
+	sc := bufio.NewScanner(r.Body)
+	sc.Buffer(make([]byte, 64*1024), 100*1024*1024)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", "Malformed action/metadata line")
+			return
+		}
+		for op, meta := range action {
+			if op != "index" && op != "create" {
+				errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", "Unsupported action: ["+op+"]")
+				return
+			}
+			if !sc.Scan() {
+				errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", "The bulk request must be terminated by a newline [\\n]")
+				return
+			}
+			idx := meta.Index
+			if idx == "" {
+				idx = defaultIdx
+			}
+			if idx == "" {
+				errorResponse(w, http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: index is missing;")
+				return
+			}
+
+			stream := s.dataStreams[idx]
+			if stream == nil && s.writeIndex(idx) == nil {
+				if t := s.matchTemplate(idx); t != nil && t.DataStream {
+					stream = s.newDataStream(idx, t)
+				}
+			}
+			if stream != nil {
+				idx = stream.Indices[len(stream.Indices)-1]
+			} else if ix := s.writeIndex(idx); ix != nil {
+				idx = ix.Name
+			}
+			res := result{Index: idx, ID: meta.ID}
+			var doc map[string]interface{}
+			if err := json.Unmarshal(sc.Bytes(), &doc); err != nil {
+				res.Status = http.StatusBadRequest
+				res.Error = &ItemError{Type: "mapper_parsing_exception", Reason: "failed to parse: " + err.Error()}
+			} else if stream != nil && op != "create" {
+				res.Status = http.StatusBadRequest
+				res.Error = &ItemError{Type: "illegal_argument_exception", Reason: "only write ops with an op_type of create are allowed in data streams"}
+			} else if _, ok := doc["@timestamp"]; stream != nil && !ok {
+				res.Status = http.StatusBadRequest
+				res.Error = &ItemError{Type: "illegal_argument_exception", Reason: "data stream timestamp field [@timestamp] is missing"}
+			} else if ix := s.indices[idx]; ix != nil && ix.WriteBlocked {
+				res.Status = http.StatusForbidden
+				res.Error = &ItemError{Type: "cluster_block_exception", Reason: "index [" + idx + "] blocked by: [FORBIDDEN/8/index write (api)];"}
+			} else if s.BulkFailure != nil {
+				res.Error = s.BulkFailure(idx, doc)
+				if res.Error != nil {
+					res.Status = res.Error.Status
+					if res.Status == 0 {
+						res.Status = http.StatusBadRequest
+					}
+				}
+			}
+			if res.Error == nil {
+				ix, ok := s.indices[idx]
+				if !ok { // auto-create, like a default cluster
+					var err error
+					if ix, err = s.newIndex(idx, nil); err != nil {
+						res.Status = http.StatusBadRequest
+						res.Error = &ItemError{Type: "invalid_alias_name_exception", Reason: err.Error()}
+						errors = true
+						items = append(items, map[string]result{op: res})
+						continue
+					}
+				}
+				if res.ID == "" {
+					res.ID = strconv.Itoa(len(ix.Docs) + 1)
+				}
+				if _, exists := ix.ids[res.ID]; exists && op == "create" {
+					res.Status = http.StatusConflict
+					res.Error = &ItemError{Type: "version_conflict_engine_exception", Reason: "[" + res.ID + "]: version conflict, document already exists"}
+					errors = true
+				} else if ix.put(Doc{ID: res.ID, Source: doc}) {
+					res.Status = http.StatusCreated
+					res.Result = "created"
+				} else {
+					res.Status = http.StatusOK
+					res.Result = "updated"
+				}
+			} else {
+				errors = true
+			}
+			items = append(items, map[string]result{op: res})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"took":   1,
+		"errors": errors,
+		"items":  items,
+	})
+}
+
+func (s *Server) nodes(w http.ResponseWriter, r *http.Request) {
+	addrs := s.PublishAddresses
+	if len(addrs) == 0 {
+		addrs = []string{s.Listener.Addr().String()}
+	}
+	nodes := make(map[string]interface{})
+	for i, a := range addrs {
+		nodes[fmt.Sprintf("node-%d", i)] = map[string]interface{}{
+			"name": fmt.Sprintf("es%02d", i),
+			"http": map[string]interface{}{"publish_address": a},
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_nodes":       map[string]int{"total": len(addrs), "successful": len(addrs), "failed": 0},
+		"cluster_name": "elastictest",
+		"nodes":        nodes,
+	})
+}
+
+func (s *Server) count(w http.ResponseWriter, r *http.Request, idx string) {
+	s.mu.Lock()
+	ixs := s.resolve(idx)
+	n := 0
+	for _, ix := range ixs {
+		n += len(ix.Docs)
+	}
+	s.mu.Unlock()
+	if len(ixs) == 0 {
+		notFound(w, idx)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": n})
+}
+
+// the explicit mappings of each index, plus dynamic ones for fields its
+// documents brought that weren't mapped, as a default cluster adds them
+func (s *Server) mapping(w http.ResponseWriter, r *http.Request, idx string) {
+	s.mu.Lock()
+	ixs := s.resolve(idx)
+	res := make(map[string]interface{}, len(ixs))
+	for _, ix := range ixs {
+		var body struct {
+			Mappings struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"mappings"`
+		}
+		json.Unmarshal(ix.Settings, &body) // nolint: validated on the way in
+		props := body.Mappings.Properties
+		if props == nil {
+			props = make(map[string]interface{})
+		}
+		for _, d := range ix.Docs {
+			dynamicMapping(props, d.Source)
+		}
+		res[ix.Name] = map[string]interface{}{"mappings": map[string]interface{}{"properties": props}}
+	}
+	s.mu.Unlock()
+	if len(ixs) == 0 {
+		notFound(w, idx)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// adds mappings for the fields of doc missing from props, guessing types
+// the way Elasticsearch's dynamic mapping does
+func dynamicMapping(props map[string]interface{}, doc map[string]interface{}) {
+	for k, v := range doc {
+		if obj, ok := v.(map[string]interface{}); ok {
+			m, _ := props[k].(map[string]interface{})
+			if m == nil {
+				m = map[string]interface{}{"properties": map[string]interface{}{}}
+				props[k] = m
+			}
+			sub, _ := m["properties"].(map[string]interface{})
+			if sub == nil {
+				continue // mapped as something other than an object
+			}
+			dynamicMapping(sub, obj)
+			continue
+		}
+		if _, ok := props[k]; ok || v == nil {
+			continue
+		}
+		switch v := v.(type) {
+		case bool:
+			props[k] = map[string]interface{}{"type": "boolean"}
+		case float64:
+			if v == math.Trunc(v) {
+				props[k] = map[string]interface{}{"type": "long"}
+			} else {
+				props[k] = map[string]interface{}{"type": "float"}
+			}
+		case string:
+			if _, err := time.Parse("2006-01-02", v); err == nil {
+				props[k] = map[string]interface{}{"type": "date"}
+			} else if _, err := time.Parse("2006-01-02T15:04:05", v); err == nil {
+				props[k] = map[string]interface{}{"type": "date"}
+			} else {
+				props[k] = map[string]interface{}{
+					"type":   "text",
+					"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+				}
+			}
+		}
+	}
+}
+
+// match_all only; honours size and from from the query string
+func (s *Server) search(w http.ResponseWriter, r *http.Request, idx string) {
+	size, from := 10, 0
+	if v, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+		size = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("from")); err == nil {
+		from = v
+	}
+
+	type hit struct {
+		index string
+		Doc
+	}
+	s.mu.Lock()
+	ixs := s.resolve(idx)
+	var docs []hit
+	for _, ix := range ixs {
+		for _, d := range ix.Docs {
+			docs = append(docs, hit{ix.Name, d})
+		}
+	}
+	s.mu.Unlock()
+	if len(ixs) == 0 {
+		notFound(w, idx)
+		return
+	}
+
+	hits := []map[string]interface{}{}
+	for i := from; i < len(docs) && i < from+size; i++ {
+		hits = append(hits, map[string]interface{}{
+			"_index":  docs[i].index,
+			"_id":     docs[i].ID,
+			"_score":  1.0,
+			"_source": docs[i].Source,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"hits": map[string]interface{}{
+			"total":     map[string]interface{}{"value": len(docs), "relation": "eq"},
+			"max_score": 1.0,
+			"hits":      hits,
+		},
+	})
+}
+
+// creates an index, from the highest priority template matching its name
+// when body is empty. Caller holds s.mu
+func (s *Server) newIndex(name string, body []byte) (*Index, error) {
+	ix := &Index{Name: name, Settings: body}
+	tmpl := s.matchTemplate(name)
+	var sections []json.RawMessage
+	if tmpl != nil {
+		sections = append(sections, tmpl.Body)
+		if len(bytes.TrimSpace(body)) == 0 {
+			ix.Settings = tmpl.Body
+		}
+	}
+	sections = append(sections, body)
+	for _, sec := range sections {
+		var is struct {
+			Aliases map[string]json.RawMessage `json:"aliases"`
+		}
+		json.Unmarshal(sec, &is) // nolint: validated on the way in
+		for a := range is.Aliases {
+			if _, ok := s.indices[a]; ok {
+				return nil, fmt.Errorf("invalid alias name [%s], an index exists with the same name as the alias", a)
+			}
+			ix.Aliases = append(ix.Aliases, a)
+		}
+	}
+	sort.Strings(ix.Aliases)
+	s.indices[name] = ix
+	return ix, nil
+}
+
+// the highest priority template with a pattern matching name, or nil.
+// Caller holds s.mu
+func (s *Server) matchTemplate(name string) *Template {
+	var tmpl *Template
+	for _, t := range s.templates {
+		for _, p := range t.Patterns {
+			if ok, _ := path.Match(p, name); ok && (tmpl == nil || t.Priority > tmpl.Priority) {
+				tmpl = t
+			}
+		}
+	}
+	return tmpl
+}
+
+// creates a data stream and its first backing index from t. Caller holds
+// s.mu
+func (s *Server) newDataStream(name string, t *Template) *DataStream {
+	backing := fmt.Sprintf(".ds-%s-%s-%06d", name, time.Now().UTC().Format("2006.01.02"), 1)
+	s.indices[backing] = &Index{Name: backing, Settings: t.Body}
+	ds := &DataStream{Name: name, Template: t.Name, Indices: []string{backing}}
+	s.dataStreams[name] = ds
+	return ds
+}
+
+// the indices name refers to: an index, every index under an alias or
+// data stream, or every index matching a wildcard pattern. Caller holds
+// s.mu
+func (s *Server) resolve(name string) []*Index {
+	if ix, ok := s.indices[name]; ok {
+		return []*Index{ix}
+	}
+	if ds, ok := s.dataStreams[name]; ok {
+		ixs := make([]*Index, 0, len(ds.Indices))
+		for _, b := range ds.Indices {
+			ixs = append(ixs, s.indices[b])
+		}
+		return ixs
+	}
+	var ixs []*Index
+	for _, ix := range s.indices {
+		match, _ := path.Match(name, ix.Name)
+		for _, a := range ix.Aliases {
+			match = match || a == name
+		}
+		if match {
+			ixs = append(ixs, ix)
+		}
+	}
+	sort.Slice(ixs, func(i, j int) bool { return ixs[i].Name < ixs[j].Name })
+	return ixs
+}
+
+// the index writes to name go to: the index itself, or the only index
+// under an alias. Nil when there's no such index yet. Caller holds s.mu
+func (s *Server) writeIndex(name string) *Index {
+	if ix, ok := s.indices[name]; ok {
+		return ix
+	}
+	var found *Index
+	for _, ix := range s.indices {
+		for _, a := range ix.Aliases {
+			if a == name {
+				if found != nil {
+					return nil
+				}
+				found = ix
+			}
+		}
+	}
+	return found
+}
+
+func (s *Server) getTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	t, ok := s.templates[name]
+	s.mu.Unlock()
+	if !ok {
+		errorResponse(w, http.StatusNotFound, "resource_not_found_exception", "index template matching ["+name+"] not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"index_templates": []map[string]interface{}{{
+			"name": t.Name,
+			"index_template": map[string]interface{}{
+				"index_patterns": t.Patterns,
+				"priority":       t.Priority,
+				"template":       t.Body,
+			},
+		}},
+	})
+}
+
+func (s *Server) putTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	var body struct {
+		Patterns   []string        `json:"index_patterns"`
+		Priority   int             `json:"priority"`
+		Template   json.RawMessage `json:"template"`
+		DataStream json.RawMessage `json:"data_stream"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+	if len(body.Patterns) == 0 {
+		errorResponse(w, http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: index patterns are missing;")
+		return
+	}
+	if len(body.Template) == 0 {
+		body.Template = json.RawMessage(`{}`)
+	}
+	dataStream := len(body.DataStream) > 0 && string(body.DataStream) != "null"
+	var sec struct {
+		Aliases map[string]json.RawMessage `json:"aliases"`
+	}
+	json.Unmarshal(body.Template, &sec) // nolint: a bad section just has no aliases
+	if dataStream && len(sec.Aliases) > 0 {
+		errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", "template ["+name+"] has alias and data stream definitions")
+		return
+	}
+	s.mu.Lock()
+	s.templates[name] = &Template{Name: name, Patterns: body.Patterns, Priority: body.Priority, DataStream: dataStream, Body: body.Template}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+func (s *Server) deleteTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	_, ok := s.templates[name]
+	delete(s.templates, name)
+	s.mu.Unlock()
+	if !ok {
+		errorResponse(w, http.StatusNotFound, "resource_not_found_exception", "index_template ["+name+"] missing")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+func (s *Server) getDataStream(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	ds, ok := s.dataStreams[name]
+	var res map[string]interface{}
+	if ok {
+		indices := make([]map[string]string, 0, len(ds.Indices))
+		for _, b := range ds.Indices {
+			indices = append(indices, map[string]string{"index_name": b})
+		}
+		res = map[string]interface{}{
+			"name":            ds.Name,
+			"timestamp_field": map[string]string{"name": "@timestamp"},
+			"indices":         indices,
+			"generation":      len(ds.Indices),
+			"status":          "GREEN",
+			"template":        ds.Template,
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data_streams": []interface{}{res}})
+}
+
+func (s *Server) createDataStream(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dataStreams[name]; ok {
+		errorResponse(w, http.StatusBadRequest, "resource_already_exists_exception", "data_stream ["+name+"] already exists")
+		return
+	}
+	if _, ok := s.indices[name]; ok {
+		errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", "data_stream ["+name+"] conflicts with index")
+		return
+	}
+	t := s.matchTemplate(name)
+	if t == nil || !t.DataStream {
+		errorResponse(w, http.StatusBadRequest, "illegal_argument_exception", "no matching index template found for data stream ["+name+"]")
+		return
+	}
+	s.newDataStream(name, t)
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+func (s *Server) deleteDataStream(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ds, ok := s.dataStreams[name]
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	for _, b := range ds.Indices {
+		delete(s.indices, b)
+	}
+	delete(s.dataStreams, name)
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+func (s *Server) getPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	p, ok := s.policies[name]
+	s.mu.Unlock()
+	if !ok {
+		errorResponse(w, http.StatusNotFound, "resource_not_found_exception", "Lifecycle policy not found: "+name)
+		return
+	}
+	var body struct {
+		Policy json.RawMessage `json:"policy"`
+	}
+	json.Unmarshal(p, &body) // nolint: validated on the way in
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		name: map[string]interface{}{"version": 1, "policy": body.Policy},
+	})
+}
+
+func (s *Server) putPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+	var p struct {
+		Policy *struct {
+			Phases map[string]json.RawMessage `json:"phases"`
+		} `json:"policy"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+	if p.Policy == nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", "request body is missing the [policy] field")
+		return
+	}
+	for phase := range p.Policy.Phases {
+		switch phase {
+		case "hot", "warm", "cold", "frozen", "delete":
+		default:
+			errorResponse(w, http.StatusBadRequest, "x_content_parse_exception", "[policy] unknown phase ["+phase+"]")
+			return
+		}
+	}
+	s.mu.Lock()
+	s.policies[name] = body
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+func (s *Server) getAlias(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	res := make(map[string]interface{})
+	for _, ix := range s.indices {
+		for _, a := range ix.Aliases {
+			if a == name {
+				res[ix.Name] = map[string]interface{}{"aliases": map[string]interface{}{a: map[string]interface{}{}}}
+			}
+		}
+	}
+	s.mu.Unlock()
+	if len(res) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "alias [" + name + "] missing", "status": 404})
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// applies add, remove and remove_index actions, all or none
+func (s *Server) updateAliases(w http.ResponseWriter, r *http.Request) {
+	type target struct {
+		Index string `json:"index"`
+		Alias string `json:"alias"`
+	}
+	var body struct {
+		Actions []map[string]target `json:"actions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// work out the result first, so a bad action changes nothing
+	aliases := make(map[string][]string, len(s.indices))
+	for name, ix := range s.indices {
+		aliases[name] = append([]string(nil), ix.Aliases...)
+	}
+	for _, action := range body.Actions {
+		for op, t := range action {
+			if _, ok := aliases[t.Index]; !ok {
+				notFound(w, t.Index)
+				return
+			}
+			switch op {
+			case "add":
+				if _, ok := aliases[t.Alias]; ok {
+					errorResponse(w, http.StatusBadRequest, "invalid_alias_name_exception", "Invalid alias name ["+t.Alias+"]: an index or data stream exists with the same name as the alias")
+					return
+				}
+				aliases[t.Index] = append(aliases[t.Index], t.Alias)
+			case "remove":
+				kept := aliases[t.Index][:0]
+				found := false
+				for _, a := range aliases[t.Index] {
+					if a == t.Alias {
+						found = true
+						continue
+					}
+					kept = append(kept, a)
+				}
+				if !found {
+					errorResponse(w, http.StatusNotFound, "aliases_not_found_exception", "aliases ["+t.Alias+"] missing")
+					return
+				}
+				aliases[t.Index] = kept
+			case "remove_index":
+				delete(aliases, t.Index)
+			default:
+				errorResponse(w, http.StatusBadRequest, "parsing_exception", "Unknown action ["+op+"]")
+				return
+			}
+		}
+	}
+	for name, ix := range s.indices {
+		as, ok := aliases[name]
+		if !ok {
+			delete(s.indices, name)
+			continue
+		}
+		sort.Strings(as)
+		ix.Aliases = as
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+// copies documents straight away, answering with a finished task when not
+// asked to wait
+func (s *Server) reindex(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Source struct {
+			Index string `json:"index"`
+		} `json:"source"`
+		Dest struct {
+			Index    string `json:"index"`
+			Pipeline string `json:"pipeline"`
+		} `json:"dest"`
+		Script struct {
+			Source string `json:"source"`
+		} `json:"script"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	src := s.resolve(body.Source.Index)
+	if len(src) == 0 {
+		s.mu.Unlock()
+		notFound(w, body.Source.Index)
+		return
+	}
+	dest := s.writeIndex(body.Dest.Index)
+	if dest == nil {
+		var err error
+		if dest, err = s.newIndex(body.Dest.Index, nil); err != nil {
+			s.mu.Unlock()
+			errorResponse(w, http.StatusBadRequest, "invalid_alias_name_exception", err.Error())
+			return
+		}
+	}
+	total, created, updated, deleted, noops := 0, 0, 0, 0, 0
+	failures := []interface{}{}
+	for _, ix := range src {
+		for _, d := range ix.Docs {
+			total++
+			doc := d.Source
+			if s.ReindexScript != nil && body.Script.Source != "" {
+				var op string
+				doc, op = s.ReindexScript(body.Script.Source, doc)
+				switch op {
+				case "noop":
+					noops++
+					continue
+				case "delete":
+					// counted whether or not the destination had it
+					dest.remove(d.ID)
+					deleted++
+					continue
+				}
+			}
+			if s.ReindexFailure != nil {
+				if ie := s.ReindexFailure(doc); ie != nil {
+					status := ie.Status
+					if status == 0 {
+						status = http.StatusBadRequest
+					}
+					failures = append(failures, map[string]interface{}{
+						"index":  dest.Name,
+						"id":     d.ID,
+						"cause":  ie,
+						"status": status,
+					})
+					continue
+				}
+			}
+			if dest.put(Doc{ID: d.ID, Source: doc}) {
+				created++
+			} else {
+				updated++
+			}
+		}
+	}
+	res, _ := json.Marshal(map[string]interface{}{ // nolint: plain values
+		"took":              1,
+		"timed_out":         false,
+		"total":             total,
+		"created":           created,
+		"updated":           updated,
+		"deleted":           deleted,
+		"noops":             noops,
+		"version_conflicts": 0,
+		"failures":          failures,
+	})
+	var task string
+	if r.URL.Query().Get("wait_for_completion") == "false" {
+		task = fmt.Sprintf("elastictest:%d", len(s.tasks)+1)
+		s.tasks[task] = res
+	}
+	s.mu.Unlock()
+
+	if task != "" {
+		writeJSON(w, http.StatusOK, map[string]string{"task": task})
+		return
+	}
+	writeJSON(w, http.StatusOK, json.RawMessage(res))
+}
+
+func (s *Server) getTask(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	res, ok := s.tasks[id]
+	s.mu.Unlock()
+	if !ok {
+		errorResponse(w, http.StatusNotFound, "resource_not_found_exception", "task ["+id+"] isn't running and hasn't stored its results")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"completed": true,
+		"task":      map[string]interface{}{"id": id, "action": "indices:data/write/reindex"},
+		"response":  json.RawMessage(res),
+	})
+}
+
+// documents are searchable as soon as they're stored, so this only checks
+// the index exists
+func (s *Server) refresh(w http.ResponseWriter, r *http.Request, idx string) {
+	s.mu.Lock()
+	n := len(s.resolve(idx))
+	s.mu.Unlock()
+	if n == 0 {
+		notFound(w, idx)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_shards": map[string]int{"total": n, "successful": n, "failed": 0},
+	})
+}
+
+// only index.blocks.write has an effect; other settings are accepted and
+// ignored
+func (s *Server) putSettings(w http.ResponseWriter, r *http.Request, idx string) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errorResponse(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+	block, set := body["index.blocks.write"]
+	if index, ok := body["index"].(map[string]interface{}); ok {
+		if blocks, ok := index["blocks"].(map[string]interface{}); ok {
+			block, set = blocks["write"]
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ixs := s.resolve(idx)
+	if len(ixs) == 0 {
+		notFound(w, idx)
+		return
+	}
+	if set {
+		for _, ix := range ixs {
+			ix.WriteBlocked = block == true || block == "true"
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+}
+
+func settings(ix *Index) json.RawMessage {
+	if len(bytes.TrimSpace(ix.Settings)) == 0 {
+		return json.RawMessage(`{}`)
+	}
+	return ix.Settings
+}
+
+func notFound(w http.ResponseWriter, idx string) {
+	errorResponse(w, http.StatusNotFound, "index_not_found_exception", "no such index ["+idx+"]")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	errorResponse(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("Incorrect HTTP method for uri [%s] and method [%s]", r.URL.Path, r.Method))
+}
+
+func errorResponse(w http.ResponseWriter, status int, typ string, reason string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []map[string]string{{"type": typ, "reason": reason}},
+			"type":       typ,
+			"reason":     reason,
+		},
+		"status": status,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) // nolint
+}
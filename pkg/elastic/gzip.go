@@ -0,0 +1,100 @@
+package elastic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// CompressionStats counts request bodies sent gzipped
+type CompressionStats struct {
+	Requests int64
+	BytesIn  int64 // before compression
+	BytesOut int64 // sent
+}
+
+// Saved is how many bytes compression kept off the wire
+func (s CompressionStats) Saved() int64 {
+	return s.BytesIn - s.BytesOut
+}
+
+// settings and running totals, shared by copies of a Client
+type compression struct {
+	level    int
+	requests int64
+	in       int64
+	out      int64
+}
+
+// CompressionStats reports the totals so far. Zero without Gzip
+func (c Client) CompressionStats() CompressionStats {
+	if c.gzip == nil {
+		return CompressionStats{}
+	}
+	return CompressionStats{
+		Requests: atomic.LoadInt64(&c.gzip.requests),
+		BytesIn:  atomic.LoadInt64(&c.gzip.in),
+		BytesOut: atomic.LoadInt64(&c.gzip.out),
+	}
+}
+
+// gzips body if the client is set to, adding the header for it. In-memory
+// bodies are compressed up front so they can still be replayed on another
+// node; anything else is compressed as it is read. done must be called
+// once the request is finished with
+func (c Client) compress(body io.Reader, h http.Header) (r io.Reader, done func()) {
+	if c.gzip == nil || body == nil {
+		return body, func() {}
+	}
+	h.Set("Content-Encoding", "gzip")
+	atomic.AddInt64(&c.gzip.requests, 1)
+
+	switch b := body.(type) {
+	case *bytes.Buffer, *bytes.Reader, *strings.Reader:
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, c.gzip.level) // nolint: level checked in NewWithOptions
+		n, err := io.Copy(zw, b)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return &errReader{err}, func() {}
+		}
+		atomic.AddInt64(&c.gzip.in, n)
+		atomic.AddInt64(&c.gzip.out, int64(buf.Len()))
+		return bytes.NewReader(buf.Bytes()), func() {}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		cw := &countWriter{w: pw}
+		zw, _ := gzip.NewWriterLevel(cw, c.gzip.level) // nolint
+		n, err := io.Copy(zw, body)
+		if err == nil {
+			err = zw.Close()
+		}
+		atomic.AddInt64(&c.gzip.in, n)
+		atomic.AddInt64(&c.gzip.out, cw.n)
+		pw.CloseWithError(err)
+	}()
+	// unblocks the goroutine if the request gave up before reading it all
+	return pr, func() { pr.Close() }
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,100 @@
+package elastic_test
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pzl/elastibee/pkg/elastic"
+	"github.com/pzl/elastibee/pkg/elastic/elastictest"
+)
+
+// n bulk index lines, repetitive enough to compress well
+func bulkLines(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "{\"index\":{\"_id\":\"doc-%d\"}}\n{\"type\":\"thermostat\",\"zoneAveTemp\":71.5,\"n\":%d}\n", i, i)
+	}
+	return b.String()
+}
+
+func TestGzip(t *testing.T) {
+	// a node that unpacks each body before answering 503, so the request
+	// is sent on to the fake Elasticsearch
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			if zr, err := gzip.NewReader(r.Body); err == nil {
+				b, _ := io.ReadAll(zr)
+				body = string(b)
+			}
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	es := elastictest.NewServer()
+	defer es.Close()
+
+	c, err := elastic.NewWithOptions(elastic.Options{Hosts: []string{busy.URL, es.URL}, Gzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CompressionStats() != (elastic.CompressionStats{}) {
+		t.Fatalf("stats before any request: %+v", c.CompressionStats())
+	}
+
+	ctx := context.Background()
+	body := bulkLines(50)
+	if err := c.BulkContext(ctx, "eco", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 || bodies[0] != body {
+		t.Fatalf("first node didn't get the gzipped bulk body: %d requests", len(bodies))
+	}
+	// the retry sent a body the fake could unpack and index
+	if n := len(es.Docs("eco")); n != 50 {
+		t.Errorf("%d documents stored after the retry, expected 50", n)
+	}
+	if n := es.GzipRequests(); n != 1 {
+		t.Errorf("%d gzipped requests reached Elasticsearch, expected 1", n)
+	}
+
+	stats := c.CompressionStats()
+	if stats.Requests != 1 || stats.BytesIn != int64(len(body)) || stats.BytesOut <= 0 || stats.Saved() <= 0 {
+		t.Errorf("stats %+v for a %d byte body", stats, len(body))
+	}
+}
+
+func TestGzipStreamed(t *testing.T) {
+	es := elastictest.NewServer()
+	defer es.Close()
+	c, err := elastic.NewWithOptions(elastic.Options{Host: es.URL, Gzip: true, GzipLevel: gzip.BestCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not in memory, so compressed as it is sent
+	body := bulkLines(50)
+	if err := c.BulkContext(context.Background(), "eco", io.MultiReader(strings.NewReader(body))); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(es.Docs("eco")); n != 50 || es.GzipRequests() != 1 {
+		t.Errorf("%d documents stored from %d gzipped requests, expected 50 from 1", n, es.GzipRequests())
+	}
+	if stats := c.CompressionStats(); stats.BytesIn != int64(len(body)) || stats.Saved() <= 0 {
+		t.Errorf("stats %+v for a %d byte body", stats, len(body))
+	}
+}
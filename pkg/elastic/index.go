@@ -1,48 +1,54 @@
 package elastic
 
 import (
-	"errors"
+	"context"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 )
 
 func (c Client) CreateIndexFromFile(idx string, file string) error {
+	return c.CreateIndexFromFileContext(context.Background(), idx, file)
+}
+
+// CreateIndexFromFileContext creates idx with the settings and mappings
+// in file
+func (c Client) CreateIndexFromFileContext(ctx context.Context, idx string, file string) error {
 	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return c.CreateIndex(idx, f)
+	return c.CreateIndexContext(ctx, idx, f)
 }
 
 func (c Client) CreateIndex(idx string, body io.Reader) error {
-	req, err := http.NewRequest("PUT", c.Host+"/"+idx, body)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
+	return c.CreateIndexContext(context.Background(), idx, body)
+}
 
-	res, err := c.http.Do(req)
+func (c Client) CreateIndexContext(ctx context.Context, idx string, body io.Reader) error {
+	h := http.Header{"Content-Type": {"application/json"}}
+	body, done := c.compress(body, h)
+	defer done()
+	res, err := c.do(ctx, "PUT", "/"+idx, body, h)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return err
-		}
-		return errors.New(string(body))
+		return responseError(res)
 	}
 
 	return nil
 }
 
 func (c Client) IndexExists(idx string) bool {
-	res, err := c.http.Get(c.Host + "/" + idx)
+	return c.IndexExistsContext(context.Background(), idx)
+}
+
+func (c Client) IndexExistsContext(ctx context.Context, idx string) bool {
+	res, err := c.do(ctx, "GET", "/"+idx, nil, nil)
 	if err != nil {
 		return true
 	}
@@ -52,3 +58,56 @@ func (c Client) IndexExists(idx string) bool {
 	}
 	return false
 }
+
+func (c Client) HasIndex(idx string) (bool, error) {
+	return c.HasIndexContext(context.Background(), idx)
+}
+
+// HasIndexContext reports whether idx exists, as an index, alias or data
+// stream. Unlike IndexExistsContext, failing to find out is an error
+func (c Client) HasIndexContext(ctx context.Context, idx string) (bool, error) {
+	res, err := c.do(ctx, "GET", "/"+idx, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, responseError(res)
+}
+
+func (c Client) Count(idx string) (int, error) {
+	return c.CountContext(context.Background(), idx)
+}
+
+// CountContext counts the documents in idx, as of its last refresh
+func (c Client) CountContext(ctx context.Context, idx string) (int, error) {
+	var cr struct {
+		Count int `json:"count"`
+	}
+	err := c.call(ctx, "GET", "/"+idx+"/_count", nil, &cr)
+	return cr.Count, err
+}
+
+func (c Client) Refresh(idx string) error {
+	return c.RefreshContext(context.Background(), idx)
+}
+
+// RefreshContext makes everything written to idx visible to searches
+func (c Client) RefreshContext(ctx context.Context, idx string) error {
+	return c.call(ctx, "POST", "/"+idx+"/_refresh", nil, nil)
+}
+
+func (c Client) PutSettings(idx string, settings map[string]interface{}) error {
+	return c.PutSettingsContext(context.Background(), idx, settings)
+}
+
+// PutSettingsContext changes dynamic settings of idx, like
+// index.blocks.write
+func (c Client) PutSettingsContext(ctx context.Context, idx string, settings map[string]interface{}) error {
+	return c.call(ctx, "PUT", "/"+idx+"/_settings", settings, nil)
+}
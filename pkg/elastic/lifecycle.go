@@ -0,0 +1,56 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// LifecyclePolicy is an index lifecycle management (ILM) policy for a data
+// stream's backing indices. Sizes and ages are in Elasticsearch units, like
+// 50gb and 30d. Ages count from rollover; a phase left empty is skipped
+type LifecyclePolicy struct {
+	RolloverSize string // primary shard size to roll over at
+	RolloverAge  string // or age of the write index
+	WarmAfter    string
+	ColdAfter    string
+	DeleteAfter  string
+}
+
+// MarshalJSON gives the body of a _ilm/policy request
+func (p LifecyclePolicy) MarshalJSON() ([]byte, error) {
+	type obj = map[string]interface{}
+
+	rollover := obj{}
+	if p.RolloverSize != "" {
+		rollover["max_primary_shard_size"] = p.RolloverSize
+	}
+	if p.RolloverAge != "" {
+		rollover["max_age"] = p.RolloverAge
+	}
+	hot := obj{"set_priority": obj{"priority": 100}}
+	if len(rollover) > 0 {
+		hot["rollover"] = rollover
+	}
+	phases := obj{"hot": obj{"actions": hot}}
+
+	if p.WarmAfter != "" {
+		phases["warm"] = obj{"min_age": p.WarmAfter, "actions": obj{"set_priority": obj{"priority": 50}}}
+	}
+	if p.ColdAfter != "" {
+		phases["cold"] = obj{"min_age": p.ColdAfter, "actions": obj{"set_priority": obj{"priority": 0}}}
+	}
+	if p.DeleteAfter != "" {
+		phases["delete"] = obj{"min_age": p.DeleteAfter, "actions": obj{"delete": obj{}}}
+	}
+	return json.Marshal(obj{"policy": obj{"phases": phases}})
+}
+
+func (c Client) PutLifecyclePolicy(name string, p LifecyclePolicy) error {
+	return c.PutLifecyclePolicyContext(context.Background(), name, p)
+}
+
+// PutLifecyclePolicyContext installs p as name, replacing any policy of
+// that name. Indices already managed by it move to the new version
+func (c Client) PutLifecyclePolicyContext(ctx context.Context, name string, p LifecyclePolicy) error {
+	return c.call(ctx, "PUT", "/_ilm/policy/"+name, p, nil)
+}
@@ -0,0 +1,93 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// FieldMapping is how one field is mapped
+type FieldMapping struct {
+	Type   string   `json:"type"` // object fields are flattened away
+	Format string   `json:"format,omitempty"`
+	Fields []string `json:"-"` // names of multi-fields, like keyword
+}
+
+// Mappings are an index's fields by dotted name, like sensor.id
+type Mappings map[string]FieldMapping
+
+// ParseMappings flattens the mappings section of an index or template,
+// the object holding properties
+func ParseMappings(data []byte) (Mappings, error) {
+	var m struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if len(data) == 0 {
+		return Mappings{}, nil
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	fm := make(Mappings)
+	return fm, fm.add("", m.Properties)
+}
+
+func (m Mappings) add(prefix string, props map[string]json.RawMessage) error {
+	for name, raw := range props {
+		var p struct {
+			Type       string                     `json:"type"`
+			Format     string                     `json:"format"`
+			Properties map[string]json.RawMessage `json:"properties"`
+			Fields     map[string]json.RawMessage `json:"fields"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return fmt.Errorf("%s%s: %w", prefix, name, err)
+		}
+		if p.Properties != nil && (p.Type == "" || p.Type == "object" || p.Type == "nested") {
+			if err := m.add(prefix+name+".", p.Properties); err != nil {
+				return err
+			}
+			continue
+		}
+		f := FieldMapping{Type: p.Type, Format: p.Format}
+		for sub := range p.Fields {
+			f.Fields = append(f.Fields, sub)
+		}
+		m[prefix+name] = f
+	}
+	return nil
+}
+
+func (c Client) Mapping(idx string) (map[string]Mappings, error) {
+	return c.MappingContext(context.Background(), idx)
+}
+
+// MappingContext fetches the field mappings of idx, by index name. An alias,
+// data stream or pattern gives one entry for each index behind it
+func (c Client) MappingContext(ctx context.Context, idx string) (map[string]Mappings, error) {
+	res, err := c.do(ctx, "GET", "/"+idx+"/_mapping", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+
+	var mr map[string]struct {
+		Mappings json.RawMessage `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&mr); err != nil {
+		return nil, fmt.Errorf("unable to decode mapping response: %w", err)
+	}
+	all := make(map[string]Mappings, len(mr))
+	for name, ix := range mr {
+		m, err := ParseMappings(ix.Mappings)
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %w", name, err)
+		}
+		all[name] = m
+	}
+	return all, nil
+}
@@ -0,0 +1,303 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a failing node sits out, doubling with each failure in a row
+	deadBase = 30 * time.Second
+	deadMax  = 10 * time.Minute
+)
+
+// the cluster nodes requests are spread over, shared by copies of a Client
+type pool struct {
+	mu    sync.Mutex
+	nodes []*node
+	rr    int
+}
+
+type node struct {
+	url       string
+	failures  int       // in a row
+	deadUntil time.Time // zero while healthy
+}
+
+func newPool(urls []string) *pool {
+	p := &pool{}
+	for _, u := range urls {
+		p.nodes = append(p.nodes, &node{url: strings.TrimRight(u, "/")})
+	}
+	return p
+}
+
+func (p *pool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.nodes)
+}
+
+// picks the next live node in turn. When all are out, the one due back
+// soonest is tried anyway
+func (p *pool) next() *node {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for range p.nodes {
+		n := p.nodes[p.rr%len(p.nodes)]
+		p.rr++
+		if !now.Before(n.deadUntil) {
+			return n
+		}
+	}
+	soonest := p.nodes[0]
+	for _, n := range p.nodes[1:] {
+		if n.deadUntil.Before(soonest.deadUntil) {
+			soonest = n
+		}
+	}
+	return soonest
+}
+
+func (p *pool) dead(n *node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n.failures++
+	d := deadBase << uint(n.failures-1)
+	if d > deadMax || d <= 0 {
+		d = deadMax
+	}
+	n.deadUntil = time.Now().Add(d)
+}
+
+func (p *pool) alive(n *node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n.failures = 0
+	n.deadUntil = time.Time{}
+}
+
+// swaps in a new set of node URLs, keeping the health of ones already known
+func (p *pool) replace(urls []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known := make(map[string]*node, len(p.nodes))
+	for _, n := range p.nodes {
+		known[n.url] = n
+	}
+	nodes := make([]*node, 0, len(urls))
+	for _, u := range urls {
+		if n, ok := known[u]; ok {
+			nodes = append(nodes, n)
+		} else {
+			nodes = append(nodes, &node{url: u})
+		}
+	}
+	p.nodes = nodes
+}
+
+func (p *pool) urls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	urls := make([]string, len(p.nodes))
+	for i, n := range p.nodes {
+		urls[i] = n.url
+	}
+	return urls
+}
+
+// Nodes lists the URLs of the nodes requests are sent to
+func (c Client) Nodes() []string {
+	return c.nodes.urls()
+}
+
+// sends a request to the next live node. GET and HEAD are taken to be
+// idempotent; see roundTrip
+func (c Client) do(ctx context.Context, method string, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	return c.roundTrip(ctx, method, path, body, header, method == "GET" || method == "HEAD")
+}
+
+// sends a request to the next live node, moving on to another when it
+// certainly never reached Elasticsearch: the connection (through any proxy,
+// and the TLS handshake) failed, or the node answered 503 without acting
+// on it. Other failures, like a 502 or 504 from a proxy or a timeout, may
+// have left the request applied, so only idempotent ones are sent again.
+// Bodies that can't be replayed only move on when the connection failed,
+// before any of the body was sent
+func (c Client) roundTrip(ctx context.Context, method string, path string, body io.Reader, header http.Header, idempotent bool) (*http.Response, error) {
+	switch body.(type) {
+	case nil, *bytes.Buffer, *bytes.Reader, *strings.Reader:
+	default:
+		// keep the transport from closing it when a node fails, so it's
+		// still readable for the next
+		body = ioutil.NopCloser(body)
+	}
+
+	var first *http.Request
+	tries := c.nodes.len()
+	if tries == 0 {
+		return nil, errors.New("no elasticsearch nodes configured")
+	}
+	for i := 0; ; i++ {
+		n := c.nodes.next()
+		var req *http.Request
+		if first == nil {
+			var err error
+			req, err = http.NewRequestWithContext(ctx, method, n.url+path, body)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			if c.auth != "" {
+				req.Header.Set("Authorization", c.auth)
+			}
+			first = req
+		} else {
+			u, err := url.Parse(n.url + path)
+			if err != nil {
+				return nil, err
+			}
+			req = first.Clone(ctx)
+			req.URL, req.Host = u, ""
+			if first.GetBody != nil {
+				if req.Body, err = first.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		replayable := body == nil || first.GetBody != nil
+		last := i+1 >= tries
+
+		res, err := c.http.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			c.nodes.dead(n)
+			unsent := connectFailed(err)
+			if last || !(unsent || replayable && idempotent) {
+				return nil, err
+			}
+			continue
+		}
+		switch res.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			c.nodes.dead(n)
+			retry := res.StatusCode == http.StatusServiceUnavailable || idempotent
+			if !last && replayable && retry {
+				res.Body.Close()
+				continue
+			}
+		default:
+			c.nodes.alive(n)
+		}
+		return res, nil
+	}
+}
+
+// whether err came from connecting to the node, directly or through a
+// proxy, or from the TLS handshake, so no request reached Elasticsearch
+func connectFailed(err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && (op.Op == "dial" || op.Op == "proxyconnect") {
+		return true
+	}
+	var (
+		rhe   tls.RecordHeaderError // not TLS at the other end
+		alert tls.AlertError        // rejected by the server
+		cve   *tls.CertificateVerificationError
+	)
+	if errors.As(err, &rhe) || errors.As(err, &alert) || errors.As(err, &cve) {
+		return true
+	}
+	// net/http doesn't export its handshake timeout error, nor the one for
+	// a plain HTTP answer to the handshake
+	msg := err.Error()
+	return strings.HasSuffix(msg, "TLS handshake timeout") || strings.HasSuffix(msg, "server gave HTTP response to HTTPS client")
+}
+
+func (c Client) Discover() error {
+	return c.DiscoverContext(context.Background())
+}
+
+// DiscoverContext replaces the node list with the HTTP addresses the
+// cluster reports from _nodes/http, using the scheme of the first node
+func (c Client) DiscoverContext(ctx context.Context) error {
+	urls := c.nodes.urls()
+	if len(urls) == 0 {
+		return errors.New("no elasticsearch nodes to discover from")
+	}
+	base, err := url.Parse(urls[0])
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(ctx, "GET", "/_nodes/http", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+
+	var nr struct {
+		Nodes map[string]struct {
+			HTTP struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&nr); err != nil {
+		return fmt.Errorf("unable to decode nodes response: %w", err)
+	}
+
+	var found []string
+	for _, n := range nr.Nodes {
+		addr := publishAddress(n.HTTP.PublishAddress)
+		if addr == "" {
+			continue // http disabled on this node
+		}
+		found = append(found, base.Scheme+"://"+addr)
+	}
+	if len(found) == 0 {
+		return errors.New("no nodes with HTTP enabled were discovered")
+	}
+	sort.Strings(found)
+	c.nodes.replace(found)
+	return nil
+}
+
+// publish addresses come as ip:port, or hostname/ip:port when the node
+// knows its name, which is preferred so certificates can be verified
+func publishAddress(addr string) string {
+	i := strings.Index(addr, "/")
+	if i < 0 {
+		return addr
+	}
+	host, ip := addr[:i], addr[i+1:]
+	if host == "" {
+		return ip
+	}
+	_, port, err := net.SplitHostPort(ip)
+	if err != nil {
+		return ip
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,159 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pzl/elastibee/pkg/elastic/elastictest"
+)
+
+// a node answering every request with status, counting them
+func failingNode(t *testing.T, status int) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// a client trying first, then the fake Elasticsearch
+func twoNodes(t *testing.T, first string) (Client, *elastictest.Server) {
+	t.Helper()
+	es := elastictest.NewServer()
+	t.Cleanup(es.Close)
+	c, err := NewWithOptions(Options{Host: first, Hosts: []string{es.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, es
+}
+
+// a URL nothing listens on
+func closedURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func bulkBody(ids bool) string {
+	var b strings.Builder
+	for i := 0; i < 3; i++ {
+		id := ""
+		if ids {
+			id = fmt.Sprintf(`"_id":"doc-%d"`, i)
+		}
+		fmt.Fprintf(&b, "{\"index\":{%s}}\n{\"n\":%d}\n", id, i)
+	}
+	return b.String()
+}
+
+func TestRetryBulk(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		ids    bool
+		retry  bool
+	}{
+		{"unavailable", http.StatusServiceUnavailable, false, true},
+		{"bad gateway", http.StatusBadGateway, false, false},
+		{"gateway timeout", http.StatusGatewayTimeout, false, false},
+		{"bad gateway, every document with an ID", http.StatusBadGateway, true, true},
+		{"gateway timeout, every document with an ID", http.StatusGatewayTimeout, true, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			gw, hits := failingNode(t, tc.status)
+			c, es := twoNodes(t, gw.URL)
+
+			err := c.bulk(context.Background(), "eco", strings.NewReader(bulkBody(tc.ids)), tc.ids)
+			if atomic.LoadInt32(hits) != 1 {
+				t.Fatalf("first node got %d requests, expected 1", *hits)
+			}
+			if tc.retry {
+				if err != nil {
+					t.Fatalf("expected the bulk request to move on to the next node: %v", err)
+				}
+				if n := len(es.Docs("eco")); n != 3 {
+					t.Errorf("%d documents stored, expected 3", n)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected the failure to be returned")
+			}
+			if n := es.BulkRequests(); n != 0 {
+				t.Errorf("bulk request sent again after a %d, possibly applied", tc.status)
+			}
+		})
+	}
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	gw, hits := failingNode(t, http.StatusBadGateway)
+	c, _ := twoNodes(t, gw.URL)
+
+	res, err := c.do(context.Background(), "GET", "/_nodes/http", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || atomic.LoadInt32(hits) != 1 {
+		t.Errorf("GET answered %d after %d tries on the failing node, expected 200 from the next", res.StatusCode, *hits)
+	}
+}
+
+func TestRetryConnectFailed(t *testing.T) {
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	for name, first := range map[string]string{
+		"refused":        closedURL(t),
+		"untrusted cert": untrusted.URL,
+		"https to plain": strings.Replace(plain.URL, "http:", "https:", 1),
+	} {
+		first := first
+		t.Run(name, func(t *testing.T) {
+			c, es := twoNodes(t, first)
+			// a POST without IDs, sent on because it never reached the node
+			if err := c.BulkContext(context.Background(), "eco", strings.NewReader(bulkBody(false))); err != nil {
+				t.Fatalf("expected the bulk request to move on to the next node: %v", err)
+			}
+			if n := len(es.Docs("eco")); n != 3 {
+				t.Errorf("%d documents stored, expected 3", n)
+			}
+		})
+	}
+}
+
+func TestConnectFailedProxy(t *testing.T) {
+	proxy, err := url.Parse(closedURL(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+	_, err = hc.Get("http://elasticsearch.invalid:9200/")
+	if err == nil || !connectFailed(err) {
+		t.Errorf("failing to reach the proxy is a connect failure: %v", err)
+	}
+
+	if connectFailed(&json.SyntaxError{}) || connectFailed(context.DeadlineExceeded) {
+		t.Error("errors after connecting are not connect failures")
+	}
+}
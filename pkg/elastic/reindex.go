@@ -0,0 +1,85 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// how often a running reindex is checked on
+const reindexPoll = time.Second
+
+// Reindex copies the documents of one index into another
+type Reindex struct {
+	Source   string
+	Dest     string
+	Script   string // painless run on each document on the way, optional
+	Pipeline string // ingest pipeline documents go through, optional
+}
+
+// ReindexResult counts what a reindex did
+type ReindexResult struct {
+	Total            int               `json:"total"`
+	Created          int               `json:"created"`
+	Updated          int               `json:"updated"`
+	Deleted          int               `json:"deleted"`
+	Noops            int               `json:"noops"`
+	VersionConflicts int               `json:"version_conflicts"`
+	Failures         []json.RawMessage `json:"failures"`
+}
+
+func (c Client) Reindex(r Reindex) (ReindexResult, error) {
+	return c.ReindexContext(context.Background(), r)
+}
+
+// ReindexContext runs r as a task, waiting for it to finish, so it isn't
+// bound by request timeouts. Failed documents are returned as an error
+// along with the counts
+func (c Client) ReindexContext(ctx context.Context, r Reindex) (ReindexResult, error) {
+	body := map[string]interface{}{
+		"source": map[string]string{"index": r.Source},
+	}
+	dest := map[string]string{"index": r.Dest}
+	if r.Pipeline != "" {
+		dest["pipeline"] = r.Pipeline
+	}
+	body["dest"] = dest
+	if r.Script != "" {
+		body["script"] = map[string]string{"source": r.Script, "lang": "painless"}
+	}
+
+	var started struct {
+		Task string `json:"task"`
+	}
+	if err := c.call(ctx, "POST", "/_reindex?wait_for_completion=false&refresh=true", body, &started); err != nil {
+		return ReindexResult{}, err
+	}
+
+	t := time.NewTicker(reindexPoll)
+	defer t.Stop()
+	for {
+		var task struct {
+			Completed bool            `json:"completed"`
+			Error     json.RawMessage `json:"error"`
+			Response  ReindexResult   `json:"response"`
+		}
+		if err := c.call(ctx, "GET", "/_tasks/"+started.Task, nil, &task); err != nil {
+			return ReindexResult{}, err
+		}
+		if task.Completed {
+			if len(task.Error) > 0 {
+				return task.Response, fmt.Errorf("reindex %s: %s", r.Source, task.Error)
+			}
+			if f := task.Response.Failures; len(f) > 0 {
+				return task.Response, fmt.Errorf("reindex %s: %d documents failed. First: %s", r.Source, len(f), f[0])
+			}
+			return task.Response, nil
+		}
+		select {
+		case <-ctx.Done():
+			return ReindexResult{}, fmt.Errorf("reindex %s is still running as task %s: %w", r.Source, started.Task, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// IndexSettings is what an index is created with, the layout of
+// etc/mapping.json
+type IndexSettings struct {
+	Settings json.RawMessage            `json:"settings,omitempty"`
+	Mappings json.RawMessage            `json:"mappings,omitempty"`
+	Aliases  map[string]json.RawMessage `json:"aliases,omitempty"`
+}
+
+// ParseIndexSettings decodes index settings, the body of an index creation
+// request
+func ParseIndexSettings(data []byte) (IndexSettings, error) {
+	var is IndexSettings
+	err := json.Unmarshal(data, &is)
+	return is, err
+}
+
+// Set adds a single index setting, such as index.lifecycle.name, to any
+// already there
+func (is *IndexSettings) Set(key string, value interface{}) error {
+	settings := make(map[string]interface{})
+	if len(is.Settings) > 0 {
+		if err := json.Unmarshal(is.Settings, &settings); err != nil {
+			return err
+		}
+	}
+	settings[key] = value
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	is.Settings = data
+	return nil
+}
+
+// IndexTemplate is a composable template, applied to every index created
+// with a name matching one of its patterns. With DataStream set, matching
+// names become data streams instead, which can't have aliases
+type IndexTemplate struct {
+	IndexPatterns []string            `json:"index_patterns"`
+	Template      IndexSettings       `json:"template"`
+	Priority      int                 `json:"priority,omitempty"`
+	DataStream    *DataStreamTemplate `json:"data_stream,omitempty"`
+}
+
+// DataStreamTemplate marks an IndexTemplate as one for data streams
+type DataStreamTemplate struct{}
+
+func (c Client) PutIndexTemplate(name string, t IndexTemplate) error {
+	return c.PutIndexTemplateContext(context.Background(), name, t)
+}
+
+// PutIndexTemplateContext installs t as name, replacing any template of
+// that name. Existing indices are unaffected
+func (c Client) PutIndexTemplateContext(ctx context.Context, name string, t IndexTemplate) error {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	h := http.Header{"Content-Type": {"application/json"}}
+	r, done := c.compress(bytes.NewReader(body), h)
+	defer done()
+	res, err := c.do(ctx, "PUT", "/_index_template/"+name, r, h)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+// periods for time-based indices
+const (
+	Monthly = "monthly"
+	Yearly  = "yearly"
+)
+
+// TimeSuffix names the period t falls in, for the end of a time-based
+// index name: 2020.02 when monthly, 2020 when yearly
+func TimeSuffix(period string, t time.Time) (string, error) {
+	switch period {
+	case Monthly:
+		return t.Format("2006.01"), nil
+	case Yearly:
+		return t.Format("2006"), nil
+	}
+	return "", fmt.Errorf("unknown index period %q. Use %s or %s", period, Monthly, Yearly)
+}